@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hoyle1974/chorus/config"
+)
+
+// Identity is who an end user is, as vouched for by an Authenticator
+type Identity struct {
+	UserId string
+}
+
+// An Authenticator decides who a client is from the credentials it sent in
+// its hello.  It runs before the client joins any room.
+type Authenticator interface {
+	Authenticate(credentials string) (Identity, error)
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// anonymousUserId is who dev mode clients are when they don't say
+const anonymousUserId = "anonymous"
+
+// newAuthenticator picks the authenticator for cfg.Mode
+//
+//	dev  - everyone is allowed in
+//	hmac - HS256 signed JWTs, the key is cfg.Secret
+func newAuthenticator(cfg config.Auth) (Authenticator, error) {
+	switch cfg.Mode {
+	case "dev":
+		return allowAllAuthenticator{}, nil
+	case "hmac":
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("hmac authentication needs a secret")
+		}
+		return NewHMACAuthenticator([]byte(cfg.Secret)), nil
+	}
+	return nil, fmt.Errorf("unknown authenticator %q", cfg.Mode)
+}
+
+// ---------------- dev
+
+// allowAllAuthenticator lets anyone in.  Whatever credentials a client sends
+// become its user id so it is easy to pretend to be several users.
+type allowAllAuthenticator struct{}
+
+func (allowAllAuthenticator) Authenticate(credentials string) (Identity, error) {
+	if credentials == "" {
+		return Identity{UserId: anonymousUserId}, nil
+	}
+	return Identity{UserId: credentials}, nil
+}
+
+// ---------------- hmac
+
+// HMACAuthenticator verifies JWTs signed with HS256 using a shared secret.
+// The user id is the token's "sub" claim, "exp" and "nbf" are honoured.
+type HMACAuthenticator struct {
+	secret []byte
+	leeway time.Duration
+}
+
+func NewHMACAuthenticator(secret []byte) HMACAuthenticator {
+	return HMACAuthenticator{secret: secret, leeway: time.Duration(30) * time.Second}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp"`
+	Nbf int64  `json:"nbf"`
+}
+
+func (a HMACAuthenticator) Authenticate(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errInvalidToken
+	}
+
+	header := jwtHeader{}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return Identity{}, err
+	}
+	if header.Alg != "HS256" {
+		return Identity{}, fmt.Errorf("%w: unsupported alg %q", errInvalidToken, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return Identity{}, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	claims := jwtClaims{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return Identity{}, err
+	}
+	now := time.Now()
+	if claims.Exp != 0 && now.After(time.Unix(claims.Exp, 0).Add(a.leeway)) {
+		return Identity{}, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if claims.Nbf != 0 && now.Before(time.Unix(claims.Nbf, 0).Add(-a.leeway)) {
+		return Identity{}, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if claims.Sub == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", errInvalidToken)
+	}
+
+	return Identity{UserId: claims.Sub}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test secret")
+
+// signJWT makes a token with header and claims, signed with secret
+func signJWT(t *testing.T, secret []byte, header map[string]interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	part := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := part(header) + "." + part(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withoutSignature is the token up to and including the last dot
+func withoutSignature(token string) string {
+	return token[:strings.LastIndex(token, ".")+1]
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		token    func(t *testing.T) string
+		wantUser string
+	}{
+		{
+			name: "valid",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()})
+			},
+			wantUser: "alice",
+		},
+		{
+			name: "no expiry",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "alice"})
+			},
+			wantUser: "alice",
+		},
+		{
+			name: "expired within the leeway",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now.Add(-10 * time.Second).Unix()})
+			},
+			wantUser: "alice",
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now.Add(-time.Hour).Unix()})
+			},
+		},
+		{
+			name: "not valid yet",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "alice", "nbf": now.Add(time.Hour).Unix()})
+			},
+		},
+		{
+			name: "wrong algorithm",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, map[string]interface{}{"alg": "HS512"}, map[string]interface{}{"sub": "alice"})
+			},
+		},
+		{
+			name: "alg none",
+			token: func(t *testing.T) string {
+				token := signJWT(t, testSecret, map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "alice"})
+				return withoutSignature(token)
+			},
+		},
+		{
+			name: "signed with another secret",
+			token: func(t *testing.T) string {
+				return signJWT(t, []byte("another secret"), hs256, map[string]interface{}{"sub": "alice"})
+			},
+		},
+		{
+			name: "claims changed after signing",
+			token: func(t *testing.T) string {
+				token := signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "alice"})
+				other := signJWT(t, testSecret, hs256, map[string]interface{}{"sub": "mallory"})
+				return withoutSignature(other) + token[len(withoutSignature(token)):]
+			},
+		},
+		{
+			name: "no subject",
+			token: func(t *testing.T) string {
+				return signJWT(t, testSecret, hs256, map[string]interface{}{"exp": now.Add(time.Hour).Unix()})
+			},
+		},
+		{
+			name:  "not a jwt",
+			token: func(t *testing.T) string { return "alice" },
+		},
+		{
+			name:  "empty",
+			token: func(t *testing.T) string { return "" },
+		},
+	}
+
+	auth := NewHMACAuthenticator(testSecret)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := auth.Authenticate(tt.token(t))
+			if tt.wantUser == "" {
+				if !errors.Is(err, errInvalidToken) {
+					t.Errorf("err = %v, want errInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if identity.UserId != tt.wantUser {
+				t.Errorf("user = %q, want %q", identity.UserId, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestAllowAllAuthenticator(t *testing.T) {
+	for credentials, want := range map[string]string{"": anonymousUserId, "bob": "bob"} {
+		identity, err := allowAllAuthenticator{}.Authenticate(credentials)
+		if err != nil || identity.UserId != want {
+			t.Errorf("Authenticate(%q) = %q, %v, want %q", credentials, identity.UserId, err, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/hoyle1974/chorus/message"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+// Client commands the EndUserServer handles itself instead of passing them
+// on to a room.  In JSON mode they are ordinary messages:
+//
+//	{"Cmd":"Leave","RoomId":"R123"}
+//	{"Cmd":"ListMemberships"}
+//	{"Cmd":"ListRooms"}
+//
+// In debug mode they are /leave R123, /memberships and /rooms.
+const (
+	cmdLeave           = "Leave"
+	cmdListMemberships = "ListMemberships"
+	cmdListRooms       = "ListRooms"
+)
+
+var debugCommands = map[string]string{
+	"/leave":       cmdLeave,
+	"/memberships": cmdListMemberships,
+	"/rooms":       cmdListRooms,
+}
+
+// reservedCommands are the Cmds the servers send each other, a room takes
+// them on trust so clients may not send them
+var reservedCommands = map[string]bool{
+	"Join":  true,
+	"Ping":  true,
+	"Pong":  true,
+	"error": true,
+}
+
+func isBuiltinCommand(cmd string) bool {
+	return cmd == cmdLeave || cmd == cmdListMemberships || cmd == cmdListRooms
+}
+
+// needsRoom is false for the builtin commands that aren't about one room,
+// every other message must name a room
+func needsRoom(cmd string) bool {
+	return cmd != cmdListMemberships && cmd != cmdListRooms
+}
+
+func (c *ClientConnection) handleBuiltinCommand(msg message.Message) {
+	switch msg.Cmd {
+	case cmdLeave:
+		if !c.isMember(msg.RoomId) {
+			errMsg := message.NewErrorMessage(msg.RoomId, c.state.machineId.ListenerId(), errNotMember)
+			errMsg.ReceiverId = c.id.ListenerId()
+			c.write(c.codec.Encode(errMsg))
+			return
+		}
+		c.leaveRoom(msg.RoomId)
+
+	case cmdListMemberships:
+		c.write(c.codec.Control("Memberships", map[string]interface{}{"Rooms": c.memberships()}))
+
+	case cmdListRooms:
+		rooms, err := c.state.q.GetRooms(context.Background())
+		if err != nil {
+			c.logger.Error("Problem getting rooms", "error", err)
+			c.write(c.codec.Control("error", map[string]interface{}{"err": "could not list rooms"}))
+			return
+		}
+		list := []map[string]interface{}{}
+		for _, room := range rooms {
+			if c.isMember(room.Uuid) {
+				continue
+			}
+			list = append(list, map[string]interface{}{"RoomId": room.Uuid, "Name": room.Name})
+		}
+		c.write(c.codec.Control("Rooms", map[string]interface{}{"Rooms": list}))
+	}
+}
+
+func (c *ClientConnection) memberships() []misc.RoomId {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+
+	ret := []misc.RoomId{}
+	for roomId := range c.rooms {
+		ret = append(ret, roomId)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
-	"strings"
 	"sync"
 	"time"
 
@@ -14,12 +14,35 @@ import (
 	"github.com/hoyle1974/chorus/pubsub"
 )
 
+var errNotMember = errors.New("not a member of this room")
+
 type ClientConnection struct {
-	logger   *slog.Logger
-	id       misc.ConnectionId
-	conn     net.Conn
-	consumer *pubsub.Consumer
-	state    GlobalServerState
+	logger      *slog.Logger
+	id          misc.ConnectionId
+	identity    Identity
+	resumeToken string
+	resumed     bool
+	ended       bool
+	codec       codec
+	state       GlobalServerState
+
+	// conn is kept for the whole life of the connection, writes after it is
+	// closed are dropped and no more rooms are consumed
+	lock     sync.Mutex
+	conn     transport
+	consumer pubsub.Consumer
+	closed   bool
+
+	heartbeatStop chan struct{}
+	heartbeatDone chan struct{}
+	stopOnce      sync.Once
+
+	// The rooms this connection may talk to, kept current by joins and leaves
+	roomsLock sync.Mutex
+	rooms     map[misc.RoomId]bool
+	// The latest epoch seen from each room, messages from an owner the room
+	// has since moved away from are dropped
+	epochs map[misc.RoomId]int64
 }
 
 var connectionLock sync.Mutex
@@ -33,50 +56,177 @@ func cleanupConnections() {
 	}
 	connections = map[misc.ConnectionId]*ClientConnection{}
 }
-func cleanupConnection(cid misc.ConnectionId) {
+
+// cleanupConnection closes c once its session is over, unless it has
+// already been cleaned up or dropped
+func cleanupConnection(c *ClientConnection) {
 	connectionLock.Lock()
-	defer connectionLock.Unlock()
-	v, ok := connections[cid]
-	if ok {
-		v.Close()
+	current := connections[c.id] == c
+	if current {
+		delete(connections, c.id)
+	}
+	connectionLock.Unlock()
+
+	if current {
+		c.Close()
 	}
-	delete(connections, cid)
 }
 
-func NewConnection(state GlobalServerState, conn net.Conn) *ClientConnection {
-	c := ClientConnection{
-		id:    misc.ConnectionId("C" + misc.UUIDString()),
-		conn:  conn,
-		state: state,
+// dropConnection lets go of a local connection its client has resumed
+// somewhere else.  resumeToken is the token it was resumed with, so a late
+// drop can't catch a newer session of the same connection.
+func dropConnection(id misc.ConnectionId, resumeToken string) {
+	connectionLock.Lock()
+	c, ok := connections[id]
+	if !ok || c.resumeToken != resumeToken {
+		connectionLock.Unlock()
+		return
 	}
-	c.logger = state.logger.With("connectionId", c.id)
+	delete(connections, id)
+	connectionLock.Unlock()
+
+	c.drop()
+}
 
-	err := c.state.q.CreateConnection(c.id, state.machineId)
+// serveConnection runs a client session over any transport, starting with
+// the protocol handshake
+func serveConnection(state GlobalServerState, conn transport) {
+	h, codec, err := handshake(conn)
+	if err != nil {
+		state.logger.Warn("Handshake failed", "addr", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	identity, err := state.auth.Authenticate(h.Token)
+	if err != nil {
+		state.logger.Warn("Authentication failed", "addr", conn.RemoteAddr(), "error", err)
+		conn.WriteFrame(codec.Control("error", map[string]interface{}{"err": "authentication failed"}))
+		conn.Close()
+		return
+	}
+
+	var c *ClientConnection
+	if h.ResumeToken != "" {
+		c = ResumeConnection(state, conn, codec, identity, h.ResumeToken)
+		if c == nil {
+			conn.WriteFrame(codec.Control("error", map[string]interface{}{"err": "could not resume session, starting a new one"}))
+		}
+	}
+	if c == nil {
+		c = NewConnection(state, conn, codec, identity)
+	}
+	if c == nil {
+		conn.Close()
+		return
+	}
+	c.Run()
+}
+
+func NewConnection(state GlobalServerState, conn transport, codec codec, identity Identity) *ClientConnection {
+	c := &ClientConnection{
+		id:          misc.ConnectionId("C" + misc.UUIDString()),
+		identity:    identity,
+		resumeToken: misc.TokenString(),
+		rooms:       map[misc.RoomId]bool{},
+		epochs:      map[misc.RoomId]int64{},
+		conn:        conn,
+		codec:       codec,
+		state:       state,
+	}
+	c.logger = state.logger.With("connectionId", c.id, "userId", identity.UserId)
+
+	err := c.state.q.CreateConnection(context.Background(), c.id, state.machineId, identity.UserId, c.resumeToken)
 	if err != nil {
 		c.logger.Error("Could not create connection", "id", c.id, "error", err)
 		return nil
 	}
 
+	connectionsOpened.WithLabelValues("new").Inc()
+	c.register()
+	return c
+}
+
+// ResumeConnection picks up a connection, on whichever machine it was on,
+// for the user holding resumeToken.  Room membership is kept in the
+// database and missed room messages are still waiting in the connection's
+// consumer group.  A client often comes back before its old socket is
+// noticed to be gone, so a connection that is still attached is taken over
+// and the machine holding it told to let go.
+func ResumeConnection(state GlobalServerState, conn transport, codec codec, identity Identity, resumeToken string) *ClientConnection {
+	c := &ClientConnection{
+		identity:    identity,
+		resumeToken: misc.TokenString(),
+		resumed:     true,
+		rooms:       map[misc.RoomId]bool{},
+		epochs:      map[misc.RoomId]int64{},
+		conn:        conn,
+		codec:       codec,
+		state:       state,
+	}
+
+	dbConn, takenFrom, err := c.state.q.ResumeConnection(context.Background(), resumeToken, identity.UserId, state.machineId, c.resumeToken)
+	if err != nil {
+		state.logger.Warn("Could not resume connection", "error", err)
+		return nil
+	}
+	c.id = dbConn.Uuid
+	c.logger = state.logger.With("connectionId", c.id, "userId", identity.UserId)
+	c.logger.Info("Resumed connection")
+
+	switch takenFrom {
+	case misc.NilMachineId:
+		// It was detached, nobody is holding on to it
+	case state.machineId:
+		dropConnection(c.id, resumeToken)
+	default:
+		c.logger.Info("Taking over connection", "machineId", takenFrom)
+		cmd := message.NewClientCmd(takenFrom, c.id.ListenerId(), "ClientDrop", map[string]interface{}{"ResumeToken": resumeToken})
+		c.state.bus.SendMessage(&cmd)
+	}
+
+	connectionsOpened.WithLabelValues("resumed").Inc()
+	c.register()
+	return c
+}
+
+func (c *ClientConnection) register() {
 	connectionLock.Lock()
-	connections[c.id] = &c
+	connections[c.id] = c
 	connectionLock.Unlock()
 
-	go func() {
-		for {
-			time.Sleep(time.Duration(3) * time.Second)
-			connectionLock.Lock()
-			_, ok := connections[c.id]
-			connectionLock.Unlock()
-			if ok {
-				state.q.TouchConnection(c.id)
-			} else {
-				return
+	c.heartbeatStop = make(chan struct{})
+	c.heartbeatDone = make(chan struct{})
+	go c.heartbeat()
+}
+
+// heartbeat keeps the connection from expiring until stopHeartbeat
+func (c *ClientConnection) heartbeat() {
+	defer close(c.heartbeatDone)
+	ticker := time.NewTicker(c.state.liveness.ConnectionHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.heartbeatStop:
+			return
+		case <-ticker.C:
+			err := c.state.q.TouchConnection(context.Background(), c.id, c.state.machineId)
+			if err != nil {
+				c.logger.Warn("Could not touch connection", "error", err)
 			}
 		}
-	}()
+	}
+}
 
-	return &c
+// stopHeartbeat returns once the last touch is done, a touch after a
+// detach would reattach the connection
+func (c *ClientConnection) stopHeartbeat() {
+	c.stopOnce.Do(func() {
+		close(c.heartbeatStop)
+		<-c.heartbeatDone
+	})
 }
+
 func findLocalClientConnection(id misc.ConnectionId) *ClientConnection {
 	connectionLock.Lock()
 	defer connectionLock.Unlock()
@@ -86,15 +236,62 @@ func findLocalClientConnection(id misc.ConnectionId) *ClientConnection {
 	return conn
 }
 
+// Close lets go of the socket.  Unless the client ended the session the
+// connection is only detached, so the client can resume it for a while.
 func (c *ClientConnection) Close() {
-	//TODO room.LeaveAllRooms(misc.ListenerId(c.id))
-	err := c.state.q.DeleteConnection(c.id)
+	c.stopHeartbeat()
+	c.closeTransport()
+
+	if c.ended {
+		c.leaveAllRooms()
+		err := c.state.q.DeleteConnection(context.Background(), c.id)
+		if err != nil {
+			c.state.logger.Warn("Error deleting connection", "error", err, "connectionId", c.id)
+		}
+	} else {
+		err := c.state.q.DetachConnection(context.Background(), c.id, c.state.machineId)
+		if err != nil {
+			c.state.logger.Warn("Error detaching connection", "error", err, "connectionId", c.id)
+		}
+	}
+}
+
+// drop lets go of the socket of a connection resumed somewhere else, the
+// connection itself belongs to the new socket now
+func (c *ClientConnection) drop() {
+	c.logger.Info("Connection resumed elsewhere, dropping the socket")
+	c.stopHeartbeat()
+	c.closeTransport()
+}
+
+// write sends a frame to the client, unless the connection is closed
+func (c *ClientConnection) write(frame []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	err := c.conn.WriteFrame(frame)
 	if err != nil {
-		c.state.logger.Warn("Error deleting connection", "error", err, "connectionId", c.id)
+		c.logger.Debug("Could not write to the client", "error", err)
+	}
+}
+
+// closeTransport closes the socket and stops consuming rooms
+func (c *ClientConnection) closeTransport() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
 	}
+	c.closed = true
+	c.conn.Close()
+	consumer := c.consumer
+	c.lock.Unlock()
 
-	if c.conn != nil {
-		c.conn.Close()
+	// Not under the lock, a message being handled may be waiting to write
+	if consumer != nil {
+		consumer.Close()
 	}
 }
 
@@ -106,71 +303,185 @@ func (c *ClientConnection) OnMessageFromTopic(m pubsub.Message) {
 		c.logger.Info("Ignoring my own message")
 		return
 	}
+	if !c.isMember(msg.RoomId) {
+		// Left over from a room we have left
+		return
+	}
+	if !c.fromCurrentOwner(msg) {
+		c.logger.Warn("Dropping message from a stale room owner", "roomId", msg.RoomId, "epoch", msg.Epoch)
+		return
+	}
 	c.logger.Info("Connection.OnMessageFromTopic", "msg", msg)
-	if c.conn != nil && (msg.ReceiverId == misc.ListenerId(c.id) || msg.ReceiverId == "") {
-		c.conn.Write([]byte(msg.String() + "\n"))
+	if msg.ReceiverId == misc.ListenerId(c.id) || msg.ReceiverId == "" {
+		c.write(c.codec.Encode(*msg))
 
 		if msg.Cmd == "Ping" {
 			msg := message.NewMessage(msg.RoomId, c.id.ListenerId(), msg.SenderId, "Pong", map[string]interface{}{})
 
-			pubsub.SendMessage(&msg)
+			c.state.bus.SendMessage(&msg)
 		}
 	}
 }
 
-func (c *ClientConnection) joinRoom(roomId misc.RoomId) {
-	c.conn.Write([]byte(">>> Joining " + roomId + "\n"))
+// consumeRoom starts listening to a room's topic.  The consumer group is
+// the connection so a resumed connection carries on where it left off.
+func (c *ClientConnection) consumeRoom(roomId misc.RoomId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
 	if c.consumer == nil {
-		c.consumer = pubsub.NewConsumer(c.logger, string(c.state.machineId), roomId.Topic(), c)
+		c.consumer = c.state.bus.NewConsumer(c.logger, string(c.id), roomId.Topic(), c)
 	} else {
 		c.consumer.AddTopic(roomId.Topic())
 	}
 	c.consumer.StartConsumer(&message.Message{})
-	msg := message.NewMessage(roomId, c.id.ListenerId(), "", "Join", map[string]interface{}{})
-	pubsub.SendMessage(&msg)
+}
+
+func (c *ClientConnection) stopConsumingRoom(roomId misc.RoomId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed && c.consumer != nil {
+		c.consumer.RemoveTopic(roomId.Topic())
+	}
+}
+
+func (c *ClientConnection) isMember(roomId misc.RoomId) bool {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	return c.rooms[roomId]
+}
+
+// fromCurrentOwner is false for a message a room sent from an epoch older
+// than one we have already seen
+func (c *ClientConnection) fromCurrentOwner(msg *message.Message) bool {
+	if msg.SenderId != msg.RoomId.ListenerId() || msg.Epoch == 0 {
+		return true
+	}
+
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	if msg.Epoch < c.epochs[msg.RoomId] {
+		return false
+	}
+	c.epochs[msg.RoomId] = msg.Epoch
+	return true
+}
+
+func (c *ClientConnection) setMember(roomId misc.RoomId, member bool) {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	if member {
+		c.rooms[roomId] = true
+	} else {
+		delete(c.rooms, roomId)
+		delete(c.epochs, roomId)
+	}
+}
+
+func (c *ClientConnection) joinRoom(roomId misc.RoomId) {
+	c.write(c.codec.Control("Joining", map[string]interface{}{"RoomId": roomId}))
+	c.setMember(roomId, true)
+	c.consumeRoom(roomId)
+	msg := message.Join(roomId, c.id, c.identity.UserId)
+	c.state.bus.SendMessage(&msg)
+}
+
+// rejoinRooms listens to every room a resumed connection is still a member of
+func (c *ClientConnection) rejoinRooms() {
+	roomIds, err := c.state.q.GetMembershipByConnection(context.Background(), c.id)
+	if err != nil {
+		c.logger.Error("Problem getting room membership", "error", err)
+	}
+	for _, roomId := range roomIds {
+		c.write(c.codec.Control("Rejoining", map[string]interface{}{"RoomId": roomId}))
+		c.setMember(misc.RoomId(roomId), true)
+		c.consumeRoom(misc.RoomId(roomId))
+	}
+}
+
+func (c *ClientConnection) leaveRoom(roomId misc.RoomId) {
+	if !c.isMember(roomId) {
+		return
+	}
+	c.write(c.codec.Control("Leaving", map[string]interface{}{"RoomId": roomId}))
+	c.setMember(roomId, false)
+	c.stopConsumingRoom(roomId)
+	err := c.state.q.RemoveRoomMember(context.Background(), roomId, c.id)
+	if err != nil {
+		c.logger.Error("Could not remove room member", "roomId", roomId, "error", err)
+	}
+	msg := message.Leave(roomId, c.id)
+	c.state.bus.SendMessage(&msg)
+}
+
+func (c *ClientConnection) leaveAllRooms() {
+	roomIds, err := c.state.q.GetMembershipByConnection(context.Background(), c.id)
+	if err != nil {
+		c.logger.Error("Problem getting room membership", "error", err)
+	}
+	for _, roomId := range roomIds {
+		msg := message.Leave(misc.RoomId(roomId), c.id)
+		c.state.bus.SendMessage(&msg)
+	}
 }
 
 func (c *ClientConnection) Run() {
-	defer cleanupConnection(c.id)
-	c.conn.Write([]byte(">>> Welcome " + c.id + "\n"))
+	defer cleanupConnection(c)
+	c.write(c.codec.Control("Welcome", map[string]interface{}{
+		"ConnectionId": c.id,
+		"UserId":       c.identity.UserId,
+		"Version":      ProtocolVersion,
+		"ResumeToken":  c.resumeToken,
+		"Resumed":      c.resumed,
+	}))
 
-	// We have a new connection, let's join the global lobby
-	c.joinRoom(misc.GetGlobalLobbyId())
+	if c.resumed {
+		c.rejoinRooms()
+	} else {
+		// We have a new connection, let's join the global lobby
+		c.joinRoom(misc.GetGlobalLobbyId())
+	}
 
-	c.conn.Write([]byte(">>> Ready\n"))
+	c.write(c.codec.Control("Ready", nil))
 
-	buf := make([]byte, 65536)
 	for {
-		n, err := c.conn.Read(buf)
+		frame, err := c.conn.ReadFrame()
 		if err == io.EOF {
 			c.logger.Info("Disconnect user")
-			c.conn = nil
 			return
 		}
 		if err != nil {
-			c.logger.Error("connection error", err)
-			c.conn = nil
+			c.logger.Error("connection error", "error", err)
 			return
 		}
-		// Trim trailing newline (if present)
-		words := strings.Fields(strings.TrimSpace(string(buf[:n])))
-		if len(words) == 1 {
-			if words[0] == "exit" {
-				return
-			}
+		msg, err := c.codec.Decode(c.id, frame)
+		if err == io.EOF {
+			// The client is done, there is nothing to resume
+			c.ended = true
+			return
 		}
-
-		if len(words) < 2 {
+		if errors.Is(err, errSkipFrame) {
 			continue
 		}
-		msg := message.NewMessage(misc.RoomId(words[0]), misc.ListenerId(c.id), "room", string(words[1]), map[string]interface{}{})
-
-		for t := 0; t < len(words)-2; t += 2 {
-			key := words[t+2]
-			value := words[t+3]
-			msg.Data[key] = value
+		if err != nil {
+			c.logger.Warn("Could not decode frame", "error", err)
+			c.write(c.codec.Control("error", map[string]interface{}{"err": err.Error()}))
+			continue
+		}
+		if isBuiltinCommand(msg.Cmd) {
+			c.handleBuiltinCommand(msg)
+			continue
+		}
+		if !c.isMember(msg.RoomId) {
+			c.logger.Warn("Message for a room we are not in", "roomId", msg.RoomId)
+			errMsg := message.NewErrorMessage(msg.RoomId, c.state.machineId.ListenerId(), errNotMember)
+			errMsg.ReceiverId = c.id.ListenerId()
+			c.write(c.codec.Encode(errMsg))
+			continue
 		}
-		pubsub.SendMessage(&msg)
+		c.state.bus.SendMessage(&msg)
 	}
 
 }
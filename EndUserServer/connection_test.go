@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/chorus/message"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+// fakeTransport is a client that never says anything
+type fakeTransport struct {
+	lock   sync.Mutex
+	closed bool
+	writes int
+}
+
+func (t *fakeTransport) ReadFrame() ([]byte, error) { return nil, io.EOF }
+func (t *fakeTransport) RemoteAddr() net.Addr       { return nil }
+func (t *fakeTransport) WriteFrame([]byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.writes++
+	if t.closed {
+		return net.ErrClosed
+	}
+	return nil
+}
+func (t *fakeTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	return nil
+}
+
+func (t *fakeTransport) isClosed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
+
+// drops are the machines told to let go of a connection
+func (b *recordingBus) drops() []misc.MachineId {
+	machines := []misc.MachineId{}
+	for _, sent := range b.sent {
+		if cmd, ok := sent.(*message.ClientCmd); ok && cmd.Cmd == "ClientDrop" {
+			machines = append(machines, cmd.MachineId)
+		}
+	}
+	return machines
+}
+
+func TestResumeConnection(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       misc.ConnectionId
+		machine  misc.MachineId
+		detached time.Duration
+		wantDrop bool
+	}{
+		{name: "a detached connection", id: "resume-a", machine: otherEUS, detached: time.Second},
+		{name: "attached to another machine", id: "resume-b", machine: otherEUS, wantDrop: true},
+		{name: "attached to this machine", id: "resume-c", machine: thisEUS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, mem, bus := newTestState(t, []testConnection{{id: tt.id, machine: tt.machine, detached: tt.detached}})
+			token := "token-" + string(tt.id)
+
+			// The socket this machine still holds
+			var old *ClientConnection
+			oldConn := &fakeTransport{}
+			if tt.machine == thisEUS {
+				old = &ClientConnection{id: tt.id, resumeToken: token, conn: oldConn, state: state, logger: state.logger}
+				old.register()
+			}
+
+			c := ResumeConnection(state, &fakeTransport{}, jsonCodec{}, Identity{UserId: "user-" + string(tt.id)}, token)
+			if c == nil {
+				t.Fatal("could not resume")
+			}
+			defer cleanupConnection(c)
+
+			drops := bus.drops()
+			if tt.wantDrop && (len(drops) != 1 || drops[0] != tt.machine) {
+				t.Errorf("drops = %v, want %s", drops, tt.machine)
+			}
+			if !tt.wantDrop && len(drops) != 0 {
+				t.Errorf("drops = %v, want none", drops)
+			}
+			if old != nil && !oldConn.isClosed() {
+				t.Error("the old socket is still open")
+			}
+			if findLocalClientConnection(tt.id) != c {
+				t.Error("the resumed connection isn't the local one")
+			}
+			// Dropping the old socket leaves the connection alone
+			connections, err := mem.GetConnections(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(connections) != 1 || connections[0].MachineUuid != thisEUS || connections[0].Detached() {
+				t.Errorf("connections = %+v", connections)
+			}
+		})
+	}
+}
+
+func TestClientDrop(t *testing.T) {
+	state, _, _ := newTestState(t, []testConnection{{id: "drop-a", machine: thisEUS}})
+	conn := &fakeTransport{}
+	c := &ClientConnection{id: "drop-a", resumeToken: "token-drop-a", conn: conn, state: state, logger: state.logger}
+	c.register()
+	defer cleanupConnection(c)
+
+	// A drop for an older session changes nothing
+	stale := message.NewClientCmd(thisEUS, c.id.ListenerId(), "ClientDrop", map[string]interface{}{"ResumeToken": "older"})
+	state.OnMessageFromTopic(&stale)
+	if conn.isClosed() || findLocalClientConnection(c.id) != c {
+		t.Fatal("dropped by a stale token")
+	}
+
+	drop := message.NewClientCmd(thisEUS, c.id.ListenerId(), "ClientDrop", map[string]interface{}{"ResumeToken": "token-drop-a"})
+	state.OnMessageFromTopic(&drop)
+	if !conn.isClosed() || findLocalClientConnection(c.id) != nil {
+		t.Error("still holding the connection")
+	}
+}
+
+func TestClosedConnection(t *testing.T) {
+	state, _, _ := newTestState(t, nil)
+	conn := &fakeTransport{}
+	c := NewConnection(state, conn, jsonCodec{}, Identity{UserId: "closed-user"})
+	if c == nil {
+		t.Fatal("could not connect")
+	}
+
+	// The client goes away straight after the handshake
+	c.Run()
+	if !conn.isClosed() {
+		t.Fatal("the socket was left open")
+	}
+	if findLocalClientConnection(c.id) != nil {
+		t.Error("still registered")
+	}
+
+	// A room adding it afterwards finds nothing to write to
+	conn.lock.Lock()
+	writes := conn.writes
+	conn.lock.Unlock()
+	c.joinRoom("R-late")
+	msg := message.NewMessage("R-late", "R-late", "", "Say", nil)
+	c.OnMessageFromTopic(&msg)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.writes != writes {
+		t.Errorf("%d writes after closing", conn.writes-writes)
+	}
+}
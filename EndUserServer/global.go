@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 
-	"github.com/hoyle1974/chorus/db"
+	"github.com/hoyle1974/chorus/config"
 	"github.com/hoyle1974/chorus/dbx"
 	"github.com/hoyle1974/chorus/machine"
 	"github.com/hoyle1974/chorus/message"
@@ -12,53 +13,85 @@ import (
 )
 
 type Queries interface {
-	CreateConnection(connectionId misc.ConnectionId, machineId misc.MachineId) error
-	TouchConnection(connectionId misc.ConnectionId) error
-	DeleteConnection(connectionId misc.ConnectionId) error
+	CreateConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId, userId string, resumeToken string) error
+	TouchConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error
+	DeleteConnection(ctx context.Context, connectionId misc.ConnectionId) error
+	DetachConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error
+	ResumeConnection(ctx context.Context, resumeToken string, userId string, machineId misc.MachineId, newResumeToken string) (dbx.Connection, misc.MachineId, error)
+	GetMembershipByConnection(ctx context.Context, connectionId misc.ConnectionId) ([]misc.ConnectionId, error)
+	RemoveRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error
+	GetRooms(ctx context.Context) ([]dbx.Room, error)
 }
 
 type GlobalServerState struct {
 	logger         *slog.Logger
 	machineId      misc.MachineId
-	clientCmdTopic *pubsub.Consumer
+	bus            pubsub.Bus
+	clientCmdTopic pubsub.Consumer
 	q              Queries
+	auth           Authenticator
+	liveness       config.Liveness
+	database       dbx.Database
 }
 
 func (s GlobalServerState) Logger() *slog.Logger      { return s.logger }
 func (s GlobalServerState) MachineId() misc.MachineId { return s.machineId }
 func (s GlobalServerState) MachineType() string       { return "EUS" }
+func (s GlobalServerState) Liveness() config.Liveness { return s.liveness }
+func (s GlobalServerState) Database() dbx.Database    { return s.database }
 
-func NewGlobalState(logger *slog.Logger) GlobalServerState {
+func NewGlobalState(logger *slog.Logger, bus pubsub.Bus, liveness config.Liveness, database dbx.Database, authCfg config.Auth) GlobalServerState {
 	ss := GlobalServerState{
 		logger:    logger,
 		machineId: machine.NewMachineId("EUS"),
-		q:         dbx.Dbx().Queries(db.New(dbx.GetConn())),
+		bus:       bus,
+		q:         database.Queries(),
+		liveness:  liveness,
+		database:  database,
 	}
 
-	pubsub.CreateTopic(ss.machineId.ClientCmdTopic())
+	auth, err := newAuthenticator(authCfg)
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := auth.(allowAllAuthenticator); ok {
+		logger.Warn("Dev mode authentication, every client is allowed in")
+	}
+	ss.auth = auth
+
+	ss.bus.CreateTopic(ss.machineId.ClientCmdTopic())
 
-	ss.clientCmdTopic = pubsub.NewConsumer(logger, string(ss.machineId), ss.machineId.ClientCmdTopic(), ss)
+	ss.clientCmdTopic = ss.bus.NewConsumer(logger, string(ss.machineId), ss.machineId.ClientCmdTopic(), ss)
 	ss.clientCmdTopic.StartConsumer(&message.ClientCmd{})
 
 	return ss
 }
 
 func (s GlobalServerState) Destroy() {
-	pubsub.DeleteTopic(s.machineId.ClientCmdTopic())
+	s.clientCmdTopic.Close()
+	s.bus.DeleteTopic(s.machineId.ClientCmdTopic())
 }
 
 func (s GlobalServerState) OnMessageFromTopic(m pubsub.Message) {
 	msg := m.(*message.ClientCmd)
 	s.logger.Debug("Client Command", "msg", msg)
 
-	if msg.Cmd == "ClientJoin" {
-		connectionId := misc.ConnectionId(msg.ReceiverId)
-		conn := findLocalClientConnection(connectionId)
-		if conn == nil {
-			s.logger.Warn("Tried to send a message to a local client that does not exist", "msg", msg)
-			return
-		}
-		roomId := misc.RoomId(msg.Data["RoomId"].(string))
-		conn.joinRoom(roomId)
+	connectionId := misc.ConnectionId(msg.ReceiverId)
+	conn := findLocalClientConnection(connectionId)
+	if conn == nil {
+		s.logger.Warn("Tried to send a message to a local client that does not exist", "msg", msg)
+		return
+	}
+	roomId, _ := msg.Data["RoomId"].(string)
+
+	switch msg.Cmd {
+	case "ClientJoin":
+		conn.joinRoom(misc.RoomId(roomId))
+	case "ClientLeave":
+		conn.leaveRoom(misc.RoomId(roomId))
+	case "ClientDrop":
+		// The client resumed the connection on another machine
+		resumeToken, _ := msg.Data["ResumeToken"].(string)
+		dropConnection(connectionId, resumeToken)
 	}
 }
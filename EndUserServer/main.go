@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net"
 	"os"
@@ -8,63 +9,75 @@ import (
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/hoyle1974/chorus/config"
+	"github.com/hoyle1974/chorus/dbx"
 	"github.com/hoyle1974/chorus/leader"
 	"github.com/hoyle1974/chorus/message"
+	"github.com/hoyle1974/chorus/metrics"
 	"github.com/hoyle1974/chorus/misc"
 	"github.com/hoyle1974/chorus/pubsub"
+	"github.com/hoyle1974/chorus/store"
 )
 
-func onLeaderStartFunc(ctx leader.LeaderQueryContext) {
+func (s GlobalServerState) onLeaderStartFunc(ctx leader.LeaderQueryContext) {
 	// logger.Debug("onLeaderStartFunc")
 }
 
-func leaveRoom(connectionId misc.ConnectionId, roomId misc.RoomId) {
+func (s GlobalServerState) leaveRoom(connectionId misc.ConnectionId, roomId misc.RoomId) {
 	msg := message.Leave(roomId, connectionId)
-	pubsub.SendMessage(&msg)
+	s.bus.SendMessage(&msg)
 }
 
-func deleteConnection(ctx leader.LeaderQueryContext, connectionId misc.ConnectionId) {
+func (s GlobalServerState) deleteConnection(ctx leader.LeaderQueryContext, connectionId misc.ConnectionId) {
 	ctx.Logger().Debug("Delete connection", "connectionId", connectionId)
 
-	roomIds, err := ctx.Query().GetMembershipByConnection(connectionId)
+	roomIds, err := ctx.Query().GetMembershipByConnection(ctx.Context(), connectionId)
 	if err != nil {
 		ctx.Logger().Error("Problem getting room membership", "error", err, "connectionId", connectionId)
 	}
 	for _, roomId := range roomIds {
-		leaveRoom(connectionId, misc.RoomId(roomId))
+		s.leaveRoom(connectionId, misc.RoomId(roomId))
 	}
 
-	err = ctx.Query().DeleteConnection(connectionId)
+	err = ctx.Query().DeleteConnection(ctx.Context(), connectionId)
 	if err != nil {
 		ctx.Logger().Error("Problem deleting connection", "error", err, "connectionId", connectionId)
 	}
 }
 
-func onLeaderTickFunc(ctx leader.LeaderQueryContext) {
+func (s GlobalServerState) onLeadershipLostFunc(ctx leader.LeaderQueryContext) {
+	ctx.Logger().Warn("No longer the leader")
+}
+
+func (s GlobalServerState) onLeaderTickFunc(ctx leader.LeaderQueryContext) {
 	// logger.Debug("onLeaderTickFunc")
 
 	// Cleanup old connections
-	connections, err := ctx.Query().GetConnections()
+	connections, err := ctx.Query().GetConnections(ctx.Context())
 	now := time.Now()
 	if err == nil {
 		for _, connection := range connections {
-			if now.Sub(connection.LastUpdated).Seconds() > 5 {
-				deleteConnection(ctx, connection.Uuid)
+			if connection.Detached() {
+				if now.Sub(connection.DetachedAt) > ctx.Liveness().ResumeGracePeriod {
+					s.deleteConnection(ctx, connection.Uuid)
+				}
+			} else if now.Sub(connection.LastUpdated) > ctx.Liveness().ConnectionExpiry {
+				// Nobody is looking after this connection, give the client a chance to resume it
+				err := ctx.Query().DetachConnection(ctx.Context(), connection.Uuid, connection.MachineUuid)
+				if err != nil {
+					ctx.Logger().Error("Problem detaching connection", "error", err, "connectionId", connection.Uuid)
+				}
 			}
 		}
 	} else {
 		ctx.Logger().Error("Trouble getting a list of all connections", "error", err)
 	}
 }
-func onMachineOffline(ctx leader.LeaderQueryContext, machineId misc.MachineId) {
-	// We have a machine that is offline, what cleanup should we do?
-	connections, err := ctx.Query().GetConnectionsByMachine(machineId)
-	if err == nil {
-		for _, connection := range connections {
-			deleteConnection(ctx, connection.Uuid)
-		}
-	} else {
-		ctx.Logger().Error("Could not get connectins by machine", "machineId", machineId, "error", err)
+func (s GlobalServerState) onMachineOffline(ctx leader.LeaderQueryContext, machineId misc.MachineId) {
+	// We have a machine that is offline, its clients may resume elsewhere
+	err := ctx.Query().DetachConnectionsByMachine(ctx.Context(), machineId)
+	if err != nil {
+		ctx.Logger().Error("Could not detach connections by machine", "machineId", machineId, "error", err)
 	}
 
 }
@@ -73,16 +86,45 @@ func main() {
 	handler := log.NewWithOptions(os.Stderr, log.Options{Level: log.DebugLevel})
 	logger := slog.New(handler)
 
-	state := NewGlobalState(logger)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		logger.Error("Bad config", "error", err)
+		os.Exit(2)
+	}
+	dbx.Configure(cfg.Database)
+	store.Configure(cfg.Redis)
+
+	if cfg.Database.Migrate {
+		err = dbx.Migrate(context.Background(), logger)
+		if err != nil {
+			logger.Error("Could not migrate the database", "error", err)
+			os.Exit(1)
+		}
+	}
+	err = dbx.CheckSchema(context.Background())
+	if err != nil {
+		logger.Error("Database schema is not one we can use", "error", err)
+		os.Exit(1)
+	}
 
-	leader, err := leader.StartLeaderService(state, onLeaderStartFunc, onLeaderTickFunc, onMachineOffline)
+	bus, err := pubsub.NewBus(cfg.PubSub)
 	if err != nil {
 		panic(err)
 	}
+	state := NewGlobalState(logger, bus, cfg.Liveness, dbx.Postgres(), cfg.Auth)
+	metrics.Serve(state.logger, cfg.Metrics.EndUserAddr)
 
-	ln, err := net.Listen("tcp", ":8181") // Port can be changed here
+	backend := leader.Backend(cfg.Leader.BackendFor(state.MachineType()))
+	leader, err := leader.StartLeaderService(state, backend, state.onLeaderStartFunc, state.onLeaderTickFunc, state.onMachineOffline, state.onLeadershipLostFunc)
 	if err != nil {
-		logger.Error("Error listening:", err)
+		panic(err)
+	}
+
+	// Keepalive probes find raw TCP clients that went away without a word
+	lc := net.ListenConfig{KeepAlive: cfg.Liveness.ConnectionHeartbeat}
+	ln, err := lc.Listen(context.Background(), "tcp", cfg.EndUser.TCPAddr)
+	if err != nil {
+		logger.Error("Error listening", "error", err)
 		return
 	}
 	defer ln.Close()
@@ -98,16 +140,17 @@ func main() {
 		os.Exit(0)
 	}()
 
-	state.logger.Info("EndUserServer listening on :8181")
+	startWebSocketListener(state, cfg.EndUser.WebSocketAddr)
+
+	state.logger.Info("EndUserServer listening", "addr", cfg.EndUser.TCPAddr)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			state.logger.Error("Error accepting connection:", err)
+			state.logger.Error("Error accepting connection", "error", err)
 			continue
 		}
-		state.logger.Info("Client connected:", conn.RemoteAddr())
+		state.logger.Info("Client connected", "addr", conn.RemoteAddr())
 
-		c := NewConnection(state, conn)
-		go c.Run()
+		go serveConnection(state, newTCPTransport(conn))
 	}
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/chorus/config"
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/hoyle1974/chorus/message"
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/hoyle1974/chorus/pubsub"
+)
+
+const (
+	thisEUS  = misc.MachineId("EUS-this")
+	otherEUS = misc.MachineId("EUS-other")
+	roomRS   = misc.MachineId("RS-1")
+)
+
+// recordingBus remembers what was sent on it
+type recordingBus struct {
+	*pubsub.MemoryBus
+	sent []pubsub.Message
+}
+
+func (b *recordingBus) SendMessage(msg pubsub.Message) {
+	b.sent = append(b.sent, msg)
+	b.MemoryBus.SendMessage(msg)
+}
+
+// leaves are the rooms each connection was told to leave
+func (b *recordingBus) leaves() map[misc.ConnectionId][]misc.RoomId {
+	leaves := map[misc.ConnectionId][]misc.RoomId{}
+	for _, sent := range b.sent {
+		msg := sent.(*message.Message)
+		if msg.Cmd == "Leave" {
+			connectionId := misc.ConnectionId(msg.SenderId)
+			leaves[connectionId] = append(leaves[connectionId], msg.RoomId)
+		}
+	}
+	return leaves
+}
+
+// testLeaderContext is the leader handing our state a Memory to work on
+type testLeaderContext struct {
+	GlobalServerState
+}
+
+func (c testLeaderContext) Query() dbx.QueriesX      { return c.database.Queries() }
+func (c testLeaderContext) Context() context.Context { return context.Background() }
+
+// testConnection is a connection to set up before the leader runs
+type testConnection struct {
+	id       misc.ConnectionId
+	machine  misc.MachineId
+	age      time.Duration // since it was last touched
+	detached time.Duration // how long ago it was detached, 0 for attached
+	rooms    []misc.RoomId
+}
+
+func newTestState(t *testing.T, connections []testConnection) (GlobalServerState, *dbx.Memory, *recordingBus) {
+	t.Helper()
+	ctx := context.Background()
+	mem := dbx.NewMemory()
+	bus := &recordingBus{MemoryBus: pubsub.NewMemoryBus()}
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(mem.CreateMachine(ctx, thisEUS, "EUS"))
+	must(mem.CreateMachine(ctx, otherEUS, "EUS"))
+	must(mem.CreateMachine(ctx, roomRS, "RoomServer"))
+
+	now := time.Now()
+	for _, c := range connections {
+		mem.Now = func() time.Time { return now.Add(-c.age) }
+		must(mem.CreateConnection(ctx, c.id, c.machine, "user-"+string(c.id), "token-"+string(c.id)))
+		if c.detached > 0 {
+			mem.Now = func() time.Time { return now.Add(-c.detached) }
+			must(mem.DetachConnection(ctx, c.id, c.machine))
+		}
+		for _, roomId := range c.rooms {
+			_, err := mem.GetRoom(ctx, roomId)
+			if err != nil {
+				must(mem.CreateRoom(ctx, roomId, roomRS, string(roomId), "", false, time.Minute))
+			}
+			must(mem.AddRoomMember(ctx, roomId, c.id))
+		}
+	}
+	mem.Now = time.Now
+
+	state := GlobalServerState{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		machineId: thisEUS,
+		bus:       bus,
+		q:         mem,
+		liveness:  config.DefaultLiveness(),
+		database:  mem,
+	}
+	return state, mem, bus
+}
+
+func connectionIds(t *testing.T, mem *dbx.Memory, keep func(dbx.Connection) bool) []misc.ConnectionId {
+	t.Helper()
+	connections, err := mem.GetConnections(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []misc.ConnectionId{}
+	for _, c := range connections {
+		if keep(c) {
+			ids = append(ids, c.Uuid)
+		}
+	}
+	return ids
+}
+
+func all(dbx.Connection) bool { return true }
+
+func TestOnLeaderTick(t *testing.T) {
+	liveness := config.DefaultLiveness()
+
+	tests := []struct {
+		name         string
+		connections  []testConnection
+		wantLeft     []misc.ConnectionId
+		wantDetached []misc.ConnectionId
+		wantLeaves   map[misc.ConnectionId][]misc.RoomId
+	}{
+		{
+			name:        "recently touched connections are left alone",
+			connections: []testConnection{{id: "a", machine: thisEUS}, {id: "b", machine: otherEUS, age: liveness.ConnectionExpiry / 2}},
+			wantLeft:    []misc.ConnectionId{"a", "b"},
+		},
+		{
+			name:         "a connection nobody touches is detached",
+			connections:  []testConnection{{id: "a", machine: otherEUS, age: 2 * liveness.ConnectionExpiry, rooms: []misc.RoomId{"r1"}}},
+			wantLeft:     []misc.ConnectionId{"a"},
+			wantDetached: []misc.ConnectionId{"a"},
+		},
+		{
+			name:         "a detached connection waits out the grace period",
+			connections:  []testConnection{{id: "a", machine: otherEUS, detached: liveness.ResumeGracePeriod / 2}},
+			wantLeft:     []misc.ConnectionId{"a"},
+			wantDetached: []misc.ConnectionId{"a"},
+		},
+		{
+			name: "a detached connection past the grace period leaves its rooms and is deleted",
+			connections: []testConnection{
+				{id: "a", machine: otherEUS, detached: 2 * liveness.ResumeGracePeriod, rooms: []misc.RoomId{"r1", "r2"}},
+				{id: "b", machine: thisEUS, rooms: []misc.RoomId{"r1"}},
+			},
+			wantLeft:   []misc.ConnectionId{"b"},
+			wantLeaves: map[misc.ConnectionId][]misc.RoomId{"a": {"r1", "r2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, mem, bus := newTestState(t, tt.connections)
+
+			state.onLeaderTickFunc(testLeaderContext{state})
+
+			left := connectionIds(t, mem, all)
+			if !slices.Equal(left, tt.wantLeft) {
+				t.Errorf("connections left = %v, want %v", left, tt.wantLeft)
+			}
+			detached := connectionIds(t, mem, dbx.Connection.Detached)
+			if !slices.Equal(detached, tt.wantDetached) {
+				t.Errorf("detached = %v, want %v", detached, tt.wantDetached)
+			}
+			assertLeaves(t, bus, tt.wantLeaves)
+		})
+	}
+}
+
+func TestOnMachineOffline(t *testing.T) {
+	tests := []struct {
+		name         string
+		connections  []testConnection
+		offline      misc.MachineId
+		wantDetached []misc.ConnectionId
+	}{
+		{
+			name:         "the machine's connections are detached",
+			connections:  []testConnection{{id: "a", machine: otherEUS}, {id: "b", machine: otherEUS}, {id: "c", machine: thisEUS}},
+			offline:      otherEUS,
+			wantDetached: []misc.ConnectionId{"a", "b"},
+		},
+		{
+			name:        "a machine with no connections changes nothing",
+			connections: []testConnection{{id: "a", machine: thisEUS}},
+			offline:     otherEUS,
+		},
+		{
+			name:         "connections already detached are left as they were",
+			connections:  []testConnection{{id: "a", machine: otherEUS, detached: time.Minute}},
+			offline:      otherEUS,
+			wantDetached: []misc.ConnectionId{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, mem, bus := newTestState(t, tt.connections)
+			before, err := mem.GetConnections(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state.onMachineOffline(testLeaderContext{state}, tt.offline)
+
+			detached := connectionIds(t, mem, dbx.Connection.Detached)
+			if !slices.Equal(detached, tt.wantDetached) {
+				t.Errorf("detached = %v, want %v", detached, tt.wantDetached)
+			}
+			// Clients get the grace period from when they were first detached
+			after, err := mem.GetConnections(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, c := range before {
+				if c.Detached() && !after[i].DetachedAt.Equal(c.DetachedAt) {
+					t.Errorf("%s was detached again", c.Uuid)
+				}
+			}
+			assertLeaves(t, bus, nil)
+		})
+	}
+}
+
+func TestDeleteConnection(t *testing.T) {
+	tests := []struct {
+		name        string
+		connections []testConnection
+		delete      misc.ConnectionId
+		wantLeft    []misc.ConnectionId
+		wantLeaves  map[misc.ConnectionId][]misc.RoomId
+		wantMembers map[misc.RoomId][]misc.ConnectionId
+	}{
+		{
+			name:        "a connection in no rooms",
+			connections: []testConnection{{id: "a", machine: thisEUS}, {id: "b", machine: thisEUS}},
+			delete:      "a",
+			wantLeft:    []misc.ConnectionId{"b"},
+		},
+		{
+			name: "a connection leaves every room it was in",
+			connections: []testConnection{
+				{id: "a", machine: thisEUS, rooms: []misc.RoomId{"r1", "r2"}},
+				{id: "b", machine: thisEUS, rooms: []misc.RoomId{"r2"}},
+			},
+			delete:      "a",
+			wantLeft:    []misc.ConnectionId{"b"},
+			wantLeaves:  map[misc.ConnectionId][]misc.RoomId{"a": {"r1", "r2"}},
+			wantMembers: map[misc.RoomId][]misc.ConnectionId{"r1": {}, "r2": {"b"}},
+		},
+		{
+			name:        "a connection that is already gone",
+			connections: []testConnection{{id: "b", machine: thisEUS}},
+			delete:      "a",
+			wantLeft:    []misc.ConnectionId{"b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, mem, bus := newTestState(t, tt.connections)
+
+			state.deleteConnection(testLeaderContext{state}, tt.delete)
+
+			left := connectionIds(t, mem, all)
+			if !slices.Equal(left, tt.wantLeft) {
+				t.Errorf("connections left = %v, want %v", left, tt.wantLeft)
+			}
+			assertLeaves(t, bus, tt.wantLeaves)
+			for roomId, want := range tt.wantMembers {
+				members, err := mem.GetRoomMembers(context.Background(), roomId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(members, want) {
+					t.Errorf("members of %s = %v, want %v", roomId, members, want)
+				}
+			}
+		})
+	}
+}
+
+func assertLeaves(t *testing.T, bus *recordingBus, want map[misc.ConnectionId][]misc.RoomId) {
+	t.Helper()
+	got := bus.leaves()
+	if len(got) != len(want) {
+		t.Errorf("leaves = %v, want %v", got, want)
+		return
+	}
+	for connectionId, rooms := range want {
+		slices.Sort(got[connectionId])
+		if !slices.Equal(got[connectionId], rooms) {
+			t.Errorf("leaves = %v, want %v", got, want)
+		}
+	}
+}
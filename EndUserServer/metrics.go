@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/hoyle1974/chorus/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionsHeld = promauto.With(metrics.Registry).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chorus_eus_connections",
+		Help: "Client connections this EndUserServer holds",
+	}, func() float64 {
+		connectionLock.Lock()
+		defer connectionLock.Unlock()
+		return float64(len(connections))
+	})
+	connectionsOpened = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chorus_eus_connections_opened_total",
+		Help: "Client connections started, by whether they were new or resumed",
+	}, []string{"kind"})
+)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is bumped whenever the client wire protocol changes in a
+// way older clients can't follow.
+const ProtocolVersion = 1
+
+/*
+ * Every session, whatever the transport, starts with the client sending a
+ * hello frame:
+ *
+ *	{"Version":1}
+ *
+ * after which each frame is a single message.Message as JSON.  Adding
+ * "Mode":"debug" to the hello (or sending a bare "debug" line) switches the
+ * session to the old whitespace separated "roomId Cmd k v k v" form, which is
+ * handy from telnet.
+ *
+ * Credentials for the server's Authenticator go in the hello's Token, for
+ * example a signed JWT:
+ *
+ *	{"Version":1,"Token":"eyJhbGciOi..."}
+ *
+ * The welcome frame carries a ResumeToken.  A client that loses its socket
+ * can send it back in the hello of a new session, on any EndUserServer, to
+ * get its connection and rooms back along with the messages it missed:
+ *
+ *	{"Version":1,"ResumeToken":"..."}
+ */
+
+const (
+	modeJSON  = "json"
+	modeDebug = "debug"
+)
+
+type hello struct {
+	Version     int
+	Mode        string
+	Token       string
+	ResumeToken string
+}
+
+func parseHello(frame []byte) (hello, error) {
+	h := hello{}
+	if strings.TrimSpace(string(frame)) == modeDebug {
+		return hello{Version: ProtocolVersion, Mode: modeDebug}, nil
+	}
+	err := json.Unmarshal(frame, &h)
+	if err != nil {
+		return h, fmt.Errorf("expected a hello frame: %w", err)
+	}
+	if h.Version != ProtocolVersion {
+		return h, fmt.Errorf("unsupported protocol version %d, server speaks %d", h.Version, ProtocolVersion)
+	}
+	if h.Mode == "" {
+		h.Mode = modeJSON
+	}
+	return h, nil
+}
+
+func (h hello) codec() (codec, error) {
+	switch h.Mode {
+	case modeJSON:
+		return jsonCodec{}, nil
+	case modeDebug:
+		return textCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown mode %q", h.Mode)
+}
+
+// handshake reads the hello frame and picks the codec for the rest of the
+// session.  Failures are reported to the client before returning.
+func handshake(conn transport) (hello, codec, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return hello{}, nil, err
+	}
+
+	h, err := parseHello(frame)
+	var c codec
+	if err == nil {
+		c, err = h.codec()
+	}
+	if err != nil {
+		conn.WriteFrame(jsonCodec{}.Control("error", map[string]interface{}{"err": err.Error()}))
+		return h, nil, err
+	}
+	return h, c, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hoyle1974/chorus/message"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+// A transport moves frames between a ClientConnection and the end user.
+// What a frame is depends on the transport, a line for TCP and a single
+// message for WebSockets.
+type transport interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(frame []byte) error
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// A codec turns frames into messages and back again
+type codec interface {
+	Decode(id misc.ConnectionId, frame []byte) (message.Message, error)
+	Encode(msg message.Message) []byte
+	// Control encodes a message from the EndUserServer itself, such as a
+	// welcome or an error, that isn't tied to any room
+	Control(cmd string, data map[string]interface{}) []byte
+}
+
+// errSkipFrame is returned by a codec for frames that carry no message
+var errSkipFrame = errors.New("skip frame")
+
+// fromClient fills in what a client doesn't get to choose.  A client can
+// only speak for itself, only to the room, and the user behind it comes
+// from its identity, never from what it sends.
+func fromClient(id misc.ConnectionId, msg message.Message) (message.Message, error) {
+	if reservedCommands[msg.Cmd] {
+		return msg, fmt.Errorf("%s is reserved", msg.Cmd)
+	}
+	msg.SenderId = id.ListenerId()
+	msg.ReceiverId = "room"
+	msg.Epoch = 0
+	delete(msg.Data, "UserId")
+	return msg, nil
+}
+
+// ---------------- TCP
+
+// maxFrameSize is the longest line a TCP client may send, and the biggest
+// WebSocket message
+const maxFrameSize = 1024 * 1024
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// tcpTransport carries newline delimited frames
+type tcpTransport struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func newTCPTransport(conn net.Conn) *tcpTransport {
+	return &tcpTransport{conn: conn, reader: bufio.NewReaderSize(conn, 65536)}
+}
+
+func (t *tcpTransport) ReadFrame() ([]byte, error) {
+	frame := []byte{}
+	for {
+		line, isPrefix, err := t.reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		frame = append(frame, line...)
+		if len(frame) > maxFrameSize {
+			return nil, errFrameTooLarge
+		}
+		if !isPrefix {
+			return bytes.TrimSuffix(frame, []byte("\r")), nil
+		}
+	}
+}
+
+func (t *tcpTransport) WriteFrame(frame []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	_, err := t.conn.Write(append(frame, '\n'))
+	return err
+}
+
+func (t *tcpTransport) Close() error         { return t.conn.Close() }
+func (t *tcpTransport) RemoteAddr() net.Addr { return t.conn.RemoteAddr() }
+
+// textCodec is the "roomId Cmd k v k v" form typed into a raw TCP session
+type textCodec struct{}
+
+func (textCodec) Decode(id misc.ConnectionId, frame []byte) (message.Message, error) {
+	words := strings.Fields(string(frame))
+	if len(words) == 1 {
+		if words[0] == "exit" {
+			return message.Message{}, io.EOF
+		}
+	}
+
+	if len(words) > 0 && strings.HasPrefix(words[0], "/") {
+		cmd, ok := debugCommands[words[0]]
+		if !ok {
+			return message.Message{}, fmt.Errorf("unknown command %s", words[0])
+		}
+		msg := message.Message{SenderId: id.ListenerId(), Cmd: cmd, Data: map[string]interface{}{}}
+		if len(words) > 1 {
+			msg.RoomId = misc.RoomId(words[1])
+		}
+		if msg.RoomId == "" && needsRoom(cmd) {
+			return msg, fmt.Errorf("%s needs a room", words[0])
+		}
+		return fromClient(id, msg)
+	}
+
+	if len(words) < 2 {
+		return message.Message{}, errSkipFrame
+	}
+	msg := message.NewMessage(misc.RoomId(words[0]), id.ListenerId(), "room", string(words[1]), map[string]interface{}{})
+
+	for t := 0; t+3 < len(words); t += 2 {
+		key := words[t+2]
+		value := words[t+3]
+		msg.Data[key] = value
+	}
+	return fromClient(id, msg)
+}
+
+func (textCodec) Encode(msg message.Message) []byte {
+	return []byte(msg.String())
+}
+
+func (textCodec) Control(cmd string, data map[string]interface{}) []byte {
+	keys := []string{}
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	text := ">>> " + cmd
+	for _, k := range keys {
+		text += fmt.Sprintf(" %s=%v", k, data[k])
+	}
+	return []byte(text)
+}
+
+// ---------------- JSON
+
+// jsonCodec carries one message.Message per frame, Data may hold any JSON value
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(id misc.ConnectionId, frame []byte) (message.Message, error) {
+	var msg message.Message
+	err := json.Unmarshal(frame, &msg)
+	if err != nil {
+		return msg, fmt.Errorf("invalid json: %w", err)
+	}
+	if msg.Data == nil {
+		msg.Data = map[string]interface{}{}
+	}
+	if msg.RoomId == "" && needsRoom(msg.Cmd) {
+		return msg, fmt.Errorf("message has no RoomId")
+	}
+	if msg.Cmd == "" {
+		return msg, fmt.Errorf("message has no Cmd")
+	}
+	return fromClient(id, msg)
+}
+
+func (jsonCodec) Encode(msg message.Message) []byte {
+	return []byte(msg.String())
+}
+
+func (jsonCodec) Control(cmd string, data map[string]interface{}) []byte {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	msg := message.Message{Cmd: cmd, Data: data}
+	return []byte(msg.String())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hoyle1974/chorus/misc"
+)
+
+func TestParseHello(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    string
+		wantMode string
+		wantErr  bool
+	}{
+		{name: "json", frame: `{"Version":1}`, wantMode: modeJSON},
+		{name: "debug mode", frame: `{"Version":1,"Mode":"debug"}`, wantMode: modeDebug},
+		{name: "bare debug", frame: "debug", wantMode: modeDebug},
+		{name: "bare debug with spaces", frame: "  debug \r", wantMode: modeDebug},
+		{name: "old version", frame: `{"Version":0}`, wantErr: true},
+		{name: "no version", frame: `{"Mode":"json"}`, wantErr: true},
+		{name: "not json", frame: "GlobalLobby Say", wantErr: true},
+		{name: "empty", frame: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseHello([]byte(tt.frame))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && h.Mode != tt.wantMode {
+				t.Errorf("mode = %q, want %q", h.Mode, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestParseHelloToken(t *testing.T) {
+	h, err := parseHello([]byte(`{"Version":1,"Token":"abc","ResumeToken":"def"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Token != "abc" || h.ResumeToken != "def" {
+		t.Errorf("hello = %+v", h)
+	}
+}
+
+func TestJSONCodecDecode(t *testing.T) {
+	const id = misc.ConnectionId("C1")
+	tests := []struct {
+		name         string
+		frame        string
+		wantRoom     misc.RoomId
+		wantCmd      string
+		wantReceiver misc.ListenerId
+		wantErr      bool
+	}{
+		{name: "room message", frame: `{"RoomId":"R1","Cmd":"Say","Data":{"Msg":"hi"}}`, wantRoom: "R1", wantCmd: "Say", wantReceiver: "room"},
+		{name: "receiver can't be chosen", frame: `{"RoomId":"R1","Cmd":"Say","ReceiverId":"C2"}`, wantRoom: "R1", wantCmd: "Say", wantReceiver: "room"},
+		{name: "sender can't be forged", frame: `{"RoomId":"R1","Cmd":"Say","SenderId":"C2"}`, wantRoom: "R1", wantCmd: "Say", wantReceiver: "room"},
+		{name: "epoch can't be forged", frame: `{"RoomId":"R1","Cmd":"Say","Epoch":99}`, wantRoom: "R1", wantCmd: "Say", wantReceiver: "room"},
+		{name: "user can't be forged", frame: `{"RoomId":"R1","Cmd":"Say","Data":{"UserId":"mallory"}}`, wantRoom: "R1", wantCmd: "Say", wantReceiver: "room"},
+		{name: "list rooms needs no room", frame: `{"Cmd":"ListRooms"}`, wantCmd: cmdListRooms, wantReceiver: "room"},
+		{name: "list memberships needs no room", frame: `{"Cmd":"ListMemberships"}`, wantCmd: cmdListMemberships, wantReceiver: "room"},
+		{name: "empty RoomId", frame: `{"Cmd":"Say"}`, wantErr: true},
+		{name: "leave without a room", frame: `{"Cmd":"Leave"}`, wantErr: true},
+		{name: "no Cmd", frame: `{"RoomId":"R1"}`, wantErr: true},
+		{name: "join is reserved", frame: `{"RoomId":"R1","Cmd":"Join","Data":{"UserId":"mallory"}}`, wantErr: true},
+		{name: "pong is reserved", frame: `{"RoomId":"R1","Cmd":"Pong"}`, wantErr: true},
+		{name: "ping is reserved", frame: `{"RoomId":"R1","Cmd":"Ping"}`, wantErr: true},
+		{name: "error is reserved", frame: `{"RoomId":"R1","Cmd":"error"}`, wantErr: true},
+		{name: "not json", frame: `R1 Say`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := jsonCodec{}.Decode(id, []byte(tt.frame))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msg.RoomId != tt.wantRoom || msg.Cmd != tt.wantCmd || msg.ReceiverId != tt.wantReceiver {
+				t.Errorf("msg = %+v, want room %q cmd %q receiver %q", msg, tt.wantRoom, tt.wantCmd, tt.wantReceiver)
+			}
+			if msg.SenderId != id.ListenerId() {
+				t.Errorf("sender = %q, want %q", msg.SenderId, id)
+			}
+			if msg.Epoch != 0 {
+				t.Errorf("epoch = %d", msg.Epoch)
+			}
+			if msg.Data == nil {
+				t.Error("Data is nil")
+			}
+			if _, ok := msg.Data["UserId"]; ok {
+				t.Errorf("data = %v, UserId kept", msg.Data)
+			}
+		})
+	}
+}
+
+func TestTextCodecDecode(t *testing.T) {
+	const id = misc.ConnectionId("C1")
+	tests := []struct {
+		name     string
+		frame    string
+		wantRoom misc.RoomId
+		wantCmd  string
+		wantData map[string]interface{}
+		wantErr  error // errAny for any error
+	}{
+		{name: "room message", frame: "R1 Say Msg hi", wantRoom: "R1", wantCmd: "Say", wantData: map[string]interface{}{"Msg": "hi"}},
+		{name: "odd word left over", frame: "R1 Say Msg", wantRoom: "R1", wantCmd: "Say", wantData: map[string]interface{}{}},
+		{name: "leave", frame: "/leave R1", wantRoom: "R1", wantCmd: cmdLeave, wantData: map[string]interface{}{}},
+		{name: "rooms", frame: "/rooms", wantCmd: cmdListRooms, wantData: map[string]interface{}{}},
+		{name: "user can't be forged", frame: "R1 Say UserId mallory Msg hi", wantRoom: "R1", wantCmd: "Say", wantData: map[string]interface{}{"Msg": "hi"}},
+		{name: "join is reserved", frame: "R1 Join", wantErr: errAny},
+		{name: "leave without a room", frame: "/leave", wantErr: errAny},
+		{name: "unknown command", frame: "/dance", wantErr: errAny},
+		{name: "one word", frame: "R1", wantErr: errSkipFrame},
+		{name: "blank", frame: "   ", wantErr: errSkipFrame},
+		{name: "exit", frame: "exit", wantErr: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := textCodec{}.Decode(id, []byte(tt.frame))
+			switch {
+			case tt.wantErr == errAny && err != nil:
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("err = %v", err)
+			}
+			if msg.RoomId != tt.wantRoom || msg.Cmd != tt.wantCmd {
+				t.Errorf("msg = %+v, want room %q cmd %q", msg, tt.wantRoom, tt.wantCmd)
+			}
+			if len(msg.Data) != len(tt.wantData) {
+				t.Errorf("data = %v, want %v", msg.Data, tt.wantData)
+			}
+			for key, value := range tt.wantData {
+				if msg.Data[key] != value {
+					t.Errorf("data = %v, want %v", msg.Data, tt.wantData)
+				}
+			}
+		})
+	}
+}
+
+// errAny stands for any error in the tests
+var errAny = errors.New("any error")
+
+func TestTCPTransportReadFrame(t *testing.T) {
+	long := strings.Repeat("x", 100000)
+	tests := []struct {
+		name       string
+		input      string
+		wantFrames []string
+		wantErr    error
+	}{
+		{name: "lines", input: "one\ntwo\n", wantFrames: []string{"one", "two"}, wantErr: io.EOF},
+		{name: "crlf", input: "one\r\ntwo\r\n", wantFrames: []string{"one", "two"}, wantErr: io.EOF},
+		{name: "empty line", input: "\n", wantFrames: []string{""}, wantErr: io.EOF},
+		{name: "longer than the read buffer", input: long + "\n", wantFrames: []string{long}, wantErr: io.EOF},
+		{name: "exactly the limit", input: strings.Repeat("x", maxFrameSize) + "\n", wantFrames: []string{strings.Repeat("x", maxFrameSize)}, wantErr: io.EOF},
+		{name: "over the limit", input: strings.Repeat("x", maxFrameSize+1) + "\n", wantErr: errFrameTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.input)
+				client.Close()
+			}()
+
+			tr := newTCPTransport(server)
+			for _, want := range tt.wantFrames {
+				frame, err := tr.ReadFrame()
+				if err != nil {
+					t.Fatalf("err = %v, want %q", err, want)
+				}
+				if string(frame) != want {
+					t.Fatalf("frame of %d bytes, want %d", len(frame), len(want))
+				}
+			}
+			_, err := tr.ReadFrame()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
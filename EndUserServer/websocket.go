@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Browser clients are served from anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsTransport carries one frame per WebSocket text message
+type wsTransport struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	expiry    time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWSTransport pings the client every heartbeat.  A client that has sent
+// nothing, not even a pong, for expiry is taken for gone and ReadFrame
+// fails.
+func newWSTransport(conn *websocket.Conn, heartbeat time.Duration, expiry time.Duration) *wsTransport {
+	t := &wsTransport{conn: conn, expiry: expiry, done: make(chan struct{})}
+	conn.SetReadDeadline(time.Now().Add(expiry))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(expiry))
+	})
+	go t.ping(heartbeat)
+	return t
+}
+
+func (t *wsTransport) ping(heartbeat time.Duration) {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			// WriteControl may be called alongside other writes
+			err := t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeat))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (t *wsTransport) ReadFrame() ([]byte, error) {
+	for {
+		mt, data, err := t.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		t.conn.SetReadDeadline(time.Now().Add(t.expiry))
+		if mt == websocket.TextMessage || mt == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+func (t *wsTransport) WriteFrame(frame []byte) error {
+	// gorilla/websocket allows only one concurrent writer
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+func (t *wsTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.conn.Close()
+}
+
+func (t *wsTransport) RemoteAddr() net.Addr { return t.conn.RemoteAddr() }
+
+func websocketHandler(state GlobalServerState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			state.logger.Error("Error upgrading to websocket", "error", err)
+			return
+		}
+		// Bigger messages close the connection, as long lines do over TCP
+		conn.SetReadLimit(maxFrameSize)
+		state.logger.Info("WebSocket client connected", "addr", conn.RemoteAddr())
+
+		go serveConnection(state, newWSTransport(conn, state.liveness.ConnectionHeartbeat, state.liveness.ConnectionExpiry))
+	}
+}
+
+func startWebSocketListener(state GlobalServerState, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", websocketHandler(state))
+
+	state.logger.Info("EndUserServer websocket listening on " + addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			state.logger.Error("Error listening for websockets", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/hoyle1974/chorus/message"
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/hoyle1974/chorus/pubsub"
+)
+
+/*
+ * When a RoomServer is shut down it drains: it stops taking new rooms and
+ * hands each of its rooms to another live RoomServer.  For every room it
+ *
+ *	- snapshots the room and makes the other machine the owner, in one
+ *	  transaction, and stops running it
+ *	- sends it an AdoptRoom on its RoomCmd topic
+ *
+ * The new owner binds the room, restoring the snapshot and replaying
+ * anything that came after it, and answers with RoomAdopted.  Rooms that
+ * aren't confirmed in time are left to the leader to clean up once this
+ * machine is gone.
+ */
+
+const (
+	cmdAdoptRoom   = "AdoptRoom"
+	cmdRoomAdopted = "RoomAdopted"
+)
+
+const adoptTimeout = time.Duration(10) * time.Second
+
+var (
+	errDraining    = errors.New("room server is draining")
+	errRoomStopped = errors.New("room has stopped")
+)
+
+func (rs *RoomService) OnMessageFromTopic(m pubsub.Message) {
+	msg := m.(*message.RoomCmd)
+	rs.state.logger.Debug("Room Command", "msg", msg)
+
+	switch msg.Cmd {
+	case cmdAdoptRoom:
+		if rs.bindOwnedRoom(msg) {
+			ack := message.NewRoomCmd(msg.SenderId, rs.state.machineId, msg.RoomId, cmdRoomAdopted, nil)
+			rs.state.bus.SendMessage(&ack)
+		}
+	case cmdCreateRoom:
+		rs.bindOwnedRoom(msg)
+	case cmdRoomAdopted:
+		rs.lock.Lock()
+		adopted, ok := rs.handoffs[msg.RoomId]
+		delete(rs.handoffs, msg.RoomId)
+		rs.lock.Unlock()
+		if ok {
+			close(adopted)
+		}
+	}
+}
+
+// bindOwnedRoom starts running a room another machine has made ours
+func (rs *RoomService) bindOwnedRoom(msg *message.RoomCmd) bool {
+	logger := rs.state.logger.With("roomId", msg.RoomId, "from", msg.SenderId, "cmd", msg.Cmd)
+	if rs.draining.Load() {
+		logger.Warn("Not taking a room while draining")
+		return false
+	}
+
+	q := rs.state.database.Queries()
+	room, err := q.GetRoom(context.Background(), msg.RoomId)
+	if err != nil {
+		logger.Error("Could not find room", "error", err)
+		return false
+	}
+	if room.MachineUuid != rs.state.machineId {
+		logger.Warn("Asked to run a room we don't own", "owner", room.MachineUuid)
+		return false
+	}
+
+	r := rs.bindRoomToThisMachine(RoomInfo{
+		RoomId:          room.Uuid,
+		AdminScript:     room.Script,
+		Name:            room.Name,
+		DestroyOnOrphan: room.DestroyOnOrphan,
+		Epoch:           room.Epoch,
+	})
+	if r == nil {
+		logger.Error("Could not bind room")
+		return false
+	}
+	logger.Info("Took room")
+	return true
+}
+
+// liveRoomServers are the other RoomServers that can take our rooms
+func (rs *RoomService) liveRoomServers(q dbx.QueriesX) []misc.MachineId {
+	ret := []misc.MachineId{}
+
+	machines, err := q.GetMachinesByType(context.Background(), rs.state.MachineType())
+	if err != nil {
+		rs.state.logger.Error("Could not get room servers", "error", err)
+		return ret
+	}
+	for _, machine := range machines {
+		if machine.Uuid == rs.state.machineId {
+			continue
+		}
+		if time.Since(machine.LastUpdated) < rs.state.liveness.MachineExpiry {
+			ret = append(ret, machine.Uuid)
+		}
+	}
+	return ret
+}
+
+// Drain hands every local room to the other RoomServers and waits for them
+// to be adopted
+func (rs *RoomService) Drain() {
+	rs.draining.Store(true)
+	rs.state.logger.Info("Draining")
+
+	// Stop new rooms being placed here
+	q := rs.state.database.Queries()
+	err := q.DeleteMachineLoad(context.Background(), rs.state.machineId)
+	if err != nil {
+		rs.state.logger.Error("Could not delete our load report", "error", err)
+	}
+	targets := rs.liveRoomServers(q)
+	if len(targets) == 0 {
+		rs.state.logger.Warn("No other room servers to hand rooms to")
+		return
+	}
+
+	rooms := rs.rooms()
+	waiting := map[misc.RoomId]chan struct{}{}
+	for i, r := range rooms {
+		target := targets[i%len(targets)]
+		roomId := r.info.RoomId
+
+		// Nothing is handled between the snapshot and stopping.  A room
+		// that couldn't be handed over is still ours, so it keeps running
+		// and is snapshotted with the rest at shutdown.
+		err := errRoomStopped
+		r.do(func() {
+			err = r.handOff(target)
+			if err == nil {
+				r.stop()
+			}
+		})
+		if err != nil {
+			rs.state.logger.Error("Could not hand room over", "roomId", roomId, "target", target, "error", err)
+			continue
+		}
+
+		adopted := make(chan struct{})
+		rs.lock.Lock()
+		rs.handoffs[roomId] = adopted
+		rs.lock.Unlock()
+		waiting[roomId] = adopted
+
+		cmd := message.NewRoomCmd(target, rs.state.machineId, roomId, cmdAdoptRoom, nil)
+		rs.state.bus.SendMessage(&cmd)
+	}
+
+	deadline := time.After(adoptTimeout)
+	for roomId, adopted := range waiting {
+		select {
+		case <-adopted:
+			rs.state.logger.Info("Room handed over", "roomId", roomId)
+		case <-deadline:
+			rs.state.logger.Warn("Gave up waiting for rooms to be adopted", "remaining", len(waiting))
+			return
+		}
+		delete(waiting, roomId)
+	}
+}
@@ -3,23 +3,37 @@ package main
 import (
 	"log/slog"
 
+	"github.com/hoyle1974/chorus/config"
+	"github.com/hoyle1974/chorus/dbx"
+
 	"github.com/hoyle1974/chorus/machine"
 	"github.com/hoyle1974/chorus/misc"
+	"github.com/hoyle1974/chorus/pubsub"
 )
 
 type GlobalServerState struct {
 	logger    *slog.Logger
 	machineId misc.MachineId
+	bus       pubsub.Bus
+	liveness  config.Liveness
+	database  dbx.Database
+	rooms     config.Rooms
 }
 
 func (gs GlobalServerState) Logger() *slog.Logger      { return gs.logger }
 func (gs GlobalServerState) MachineId() misc.MachineId { return gs.machineId }
 func (gs GlobalServerState) MachineType() string       { return "RoomServer" }
+func (gs GlobalServerState) Liveness() config.Liveness { return gs.liveness }
+func (gs GlobalServerState) Database() dbx.Database    { return gs.database }
 
-func NewGlobalState(logger *slog.Logger) GlobalServerState {
+func NewGlobalState(logger *slog.Logger, bus pubsub.Bus, liveness config.Liveness, database dbx.Database, rooms config.Rooms) GlobalServerState {
 	ss := GlobalServerState{
 		logger:    logger,
 		machineId: machine.NewMachineId("RS"),
+		bus:       bus,
+		liveness:  liveness,
+		database:  database,
+		rooms:     rooms,
 	}
 
 	return ss
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/hoyle1974/chorus/message"
+)
+
+/*
+ * Owning a room is a lease on its row in the rooms table.  While a room runs
+ * here the lease is renewed every RoomLeaseRenew, and whenever the room
+ * changes owner its epoch goes up by one.  The epoch is a fencing token:
+ *
+ *	- every message the room sends carries it, so listeners can drop
+ *	  messages from an owner that has been replaced
+ *	- the room's database writes check it in the same transaction, so a
+ *	  replaced owner can't overwrite the new owner's storage or snapshots
+ *
+ * A machine that can't renew, or finds a later epoch, stops running the
+ * room.  Rooms whose lease runs out are taken over by the leader.
+ */
+
+// renewLeases keeps the leases on our rooms from running out
+func (rs *RoomService) renewLeases() {
+	for {
+		time.Sleep(rs.state.liveness.RoomLeaseRenew)
+
+		q := rs.state.database.Queries()
+		for _, r := range rs.rooms() {
+			ok, err := q.RenewRoomLease(context.Background(), r.info.RoomId, rs.state.machineId, r.info.Epoch, rs.state.liveness.RoomLease)
+			if err != nil {
+				r.logger.Error("Could not renew lease", "error", err)
+				if time.Now().After(r.leaseExpires) {
+					r.logger.Warn("Lease ran out, stopping room")
+					r.stop()
+				}
+				continue
+			}
+			if !ok {
+				r.logger.Warn("Lost the room to another machine, stopping it", "epoch", r.info.Epoch)
+				r.stop()
+				continue
+			}
+			r.leaseExpires = time.Now().Add(rs.state.liveness.RoomLease)
+		}
+	}
+}
+
+// fenced runs fn in a transaction that only commits if we still own the
+// room at our epoch.  A room that finds it has been replaced stops.
+func (r *Room) fenced(fn func(q dbx.QueriesX) error) error {
+	return r.roomService.state.database.WithTx(context.Background(), func(q dbx.QueriesX) error {
+		err := q.CheckRoomEpoch(context.Background(), r.info.RoomId, r.info.Epoch)
+		if errors.Is(err, dbx.ErrStaleEpoch) {
+			r.logger.Warn("Room has a new owner, stopping it", "error", err)
+			r.stop()
+		}
+		if err != nil {
+			return err
+		}
+		return fn(q)
+	})
+}
+
+// send publishes a message from the room stamped with our epoch
+func (r *Room) send(msg message.Message) {
+	msg.Epoch = r.info.Epoch
+	r.state.bus.SendMessage(&msg)
+}
+
+// checkEpoch looks at messages the room itself sent.  One from a later epoch
+// means another machine owns the room now and we should stop.
+func (r *Room) checkEpoch(msg *message.Message) bool {
+	if msg.SenderId != r.info.RoomId.ListenerId() || msg.Epoch <= r.info.Epoch {
+		return true
+	}
+	r.logger.Warn("Room is running at a later epoch elsewhere, stopping it", "epoch", r.info.Epoch, "seen", msg.Epoch)
+	r.stop()
+	return false
+}
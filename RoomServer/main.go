@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"os/signal"
 	"time"
 
+	"github.com/hoyle1974/chorus/config"
+	"github.com/hoyle1974/chorus/dbx"
 	"github.com/hoyle1974/chorus/leader"
+	"github.com/hoyle1974/chorus/metrics"
 	"github.com/hoyle1974/chorus/misc"
+	"github.com/hoyle1974/chorus/pubsub"
+	"github.com/hoyle1974/chorus/store"
 
 	"github.com/charmbracelet/log"
 )
@@ -15,51 +21,109 @@ import (
 func onLeaderStartFunc(ctx leader.LeaderQueryContext) {
 	// logger.Debug("onLeaderStartFunc")
 }
-func onLeaderTickFunc(ctx leader.LeaderQueryContext) {
+func onLeadershipLostFunc(ctx leader.LeaderQueryContext) {
+	ctx.Logger().Warn("No longer the leader")
+}
+
+func (rs *RoomService) onLeaderTickFunc(ctx leader.LeaderQueryContext) {
 	// logger.Debug("onLeaderTickFunc")
+
+	// Rooms whose owner stopped renewing are taken over, the owner may
+	// still be running them but the new epoch fences it out
+	rooms, err := ctx.Query().GetExpiredRooms(ctx.Context())
+	if err != nil {
+		ctx.Logger().Error("Could not get expired rooms", "error", err)
+		return
+	}
+	for _, room := range rooms {
+		if room.MachineUuid == ctx.MachineId() && rs.isLocal(room.Uuid) {
+			// Ours and running, the next renewal will catch up
+			continue
+		}
+		ctx.Logger().Warn("Room lease expired", "room", room.Uuid, "owner", room.MachineUuid, "expired", room.LeaseExpires)
+		rs.takeOverRoom(ctx, room)
+	}
 }
-func onMachineOffline(ctx leader.LeaderQueryContext, machineId misc.MachineId) {
+func (rs *RoomService) onMachineOffline(ctx leader.LeaderQueryContext, machineId misc.MachineId) {
 	// We have a machine that is offline, what cleanup should we do?
 	ctx.Logger().Info("onMachineOffline", "offlineMachine", machineId)
-	rooms, err := ctx.Query().GetRoomsByMachine(machineId)
+	rooms, err := ctx.Query().GetRoomsByMachine(ctx.Context(), machineId)
 	if err != nil {
 		ctx.Logger().Error("Could not get rooms by machine", "error", err)
 		return
 	}
 	for _, room := range rooms {
-		if room.DestroyOnOrphan {
-			ctx.Query().DeleteRoom(room.Uuid)
-		} else {
-			// Someone needs to own this, for now it's us
-			err = ctx.Query().SetRoomOwner(room.Uuid, machineId, ctx.MachineId())
-			if err == nil {
-				// Successful, bind it locally
-				rs.bindRoomToThisMachine(RoomInfo{
-					RoomId:          room.Uuid,
-					AdminScript:     room.Script,
-					Name:            room.Name,
-					DestroyOnOrphan: room.DestroyOnOrphan,
-				})
-			} else {
-				ctx.Logger().Error("Error becoming owner of room", "room", room, "error", err)
-			}
-		}
+		rs.takeOverRoom(ctx, room)
 	}
 }
 
-var rs *RoomService
+// takeOverRoom cleans up after a room whose owner has gone away
+func (rs *RoomService) takeOverRoom(ctx leader.LeaderQueryContext, room dbx.Room) {
+	if room.DestroyOnOrphan {
+		err := ctx.Query().DeleteRoom(ctx.Context(), room.Uuid)
+		if err != nil {
+			ctx.Logger().Error("Could not delete orphaned room", "roomId", room.Uuid, "error", err)
+		}
+		return
+	}
+
+	// Someone needs to own this, for now it's us
+	epoch, err := ctx.Query().SetRoomOwner(ctx.Context(), room.Uuid, room.MachineUuid, ctx.MachineId(), ctx.Liveness().RoomLease)
+	if err != nil {
+		ctx.Logger().Error("Error becoming owner of room", "room", room, "error", err)
+		return
+	}
+	// Successful, bind it locally
+	rs.bindRoomToThisMachine(RoomInfo{
+		RoomId:          room.Uuid,
+		AdminScript:     room.Script,
+		Name:            room.Name,
+		DestroyOnOrphan: room.DestroyOnOrphan,
+		Epoch:           epoch,
+	})
+}
 
 func main() {
 	handler := log.NewWithOptions(os.Stderr, log.Options{Level: log.DebugLevel})
 	logger := slog.New(handler)
-	state := NewGlobalState(logger)
 
-	leader, err := leader.StartLeaderService(state, onLeaderStartFunc, onLeaderTickFunc, onMachineOffline)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		logger.Error("Bad config", "error", err)
+		os.Exit(2)
+	}
+	dbx.Configure(cfg.Database)
+	store.Configure(cfg.Redis)
+
+	if cfg.Database.Migrate {
+		err = dbx.Migrate(context.Background(), logger)
+		if err != nil {
+			logger.Error("Could not migrate the database", "error", err)
+			os.Exit(1)
+		}
+	}
+	err = dbx.CheckSchema(context.Background())
+	if err != nil {
+		logger.Error("Database schema is not one we can use", "error", err)
+		os.Exit(1)
+	}
+
+	bus, err := pubsub.NewBus(cfg.PubSub)
 	if err != nil {
 		panic(err)
 	}
+	state := NewGlobalState(logger, bus, cfg.Liveness, dbx.Postgres(), cfg.Rooms)
+	metrics.Serve(state.logger, cfg.Metrics.RoomServerAddr)
 
-	rs = StartLocalRoomService(state)
+	// The leader takes rooms over into the room service, so it has to be
+	// running first
+	rs := StartLocalRoomService(state)
+
+	backend := leader.Backend(cfg.Leader.BackendFor(state.MachineType()))
+	leader, err := leader.StartLeaderService(state, backend, onLeaderStartFunc, rs.onLeaderTickFunc, rs.onMachineOffline, onLeadershipLostFunc)
+	if err != nil {
+		panic(err)
+	}
 
 	if rs.BootstrapLobby() {
 		state.logger.Info("Global Lobby boostrapped")
@@ -70,8 +134,15 @@ func main() {
 		signal.Notify(sigchan, os.Interrupt)
 		<-sigchan
 
-		// Do any cleanup
+		// A draining machine shouldn't be taking rooms over as the leader
+		leader.StepDown()
+
+		// Hand our rooms to someone else, anything left over is
+		// snapshotted for whoever picks it up
+		rs.Drain()
+		rs.SnapshotRooms()
 		leader.Destroy()
+		rs.Destroy()
 
 		os.Exit(0)
 	}()
@@ -1,7 +1,7 @@
 var id= ""
 
 function onJoin(msg) {  
-  log("Hello from onJoin")
+  log("Hello from onJoin", msg.Data.UserId)
   if (id==="") {
     log("first user joined",msg.SenderId)
     id = msg.SenderId
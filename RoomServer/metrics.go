@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/hoyle1974/chorus/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// handlerSeconds is how long room scripts take to handle a message.  It is
+// by script rather than room or command, clients choose those.
+var handlerSeconds = promauto.With(metrics.Registry).NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "chorus_room_handler_seconds",
+	Help:    "Time a room's script spent handling a message, by script and result",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+}, []string{"script", "result"})
+
+var (
+	scriptFaults = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chorus_room_script_faults_total",
+		Help: "Room scripts terminated for running too long, by script",
+	}, []string{"script"})
+	roomsFaulted = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chorus_rooms_faulted_total",
+		Help: "Rooms destroyed because their script kept being terminated, by script",
+	}, []string{"script"})
+)
+
+// registerRoomMetrics reports on the rooms rs is running
+func registerRoomMetrics(rs *RoomService) {
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chorus_roomserver_rooms",
+		Help: "Rooms running on this RoomServer",
+	}, func() float64 {
+		return float64(len(rs.rooms()))
+	}))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+/*
+ * New rooms go on the least loaded RoomServer rather than the one that asked
+ * for them.  Every RoomServer reports its load to machine_load, NewRoom picks
+ * the machine with the lowest score, creates the room owned by it and sends
+ * it a CreateRoom on its RoomCmd topic.
+ */
+
+const cmdCreateRoom = "CreateRoom"
+
+const loadReportInterval = time.Duration(2) * time.Second
+
+// Reports older than this are from machines that are gone or stuck
+const loadReportMaxAge = 3 * loadReportInterval
+
+// loadScore weighs up a machine's load, lower is better.  A room costs about
+// as much as ten members, or 100ms of script time between reports.
+func loadScore(load dbx.MachineLoad) float64 {
+	return float64(load.Rooms) + float64(load.Members)/10 + float64(load.ScriptMillis)/100
+}
+
+func (rs *RoomService) currentLoad() dbx.MachineLoad {
+	rooms := rs.rooms()
+	members := 0
+	for _, r := range rooms {
+		members += r.memberCount()
+	}
+
+	return dbx.MachineLoad{
+		MachineId:    rs.state.machineId,
+		Rooms:        len(rooms),
+		Members:      members,
+		ScriptMillis: time.Duration(rs.scriptTime.Swap(0)).Milliseconds(),
+	}
+}
+
+func (rs *RoomService) reportLoad() {
+	for {
+		time.Sleep(loadReportInterval)
+		if rs.draining.Load() {
+			return
+		}
+
+		q := rs.state.database.Queries()
+		err := q.ReportMachineLoad(context.Background(), rs.currentLoad())
+		if err != nil {
+			rs.state.logger.Error("Could not report load", "error", err)
+		}
+	}
+}
+
+// placeRoom picks the RoomServer a new room should run on.  If nobody has
+// reported recently it is us.
+func (rs *RoomService) placeRoom() misc.MachineId {
+	q := rs.state.database.Queries()
+	loads, err := q.GetMachineLoadsByType(context.Background(), rs.state.MachineType())
+	if err != nil {
+		rs.state.logger.Error("Could not get machine loads", "error", err)
+		return rs.state.machineId
+	}
+
+	best := rs.state.machineId
+	bestScore := math.MaxFloat64
+	for _, load := range loads {
+		if time.Since(load.UpdatedAt) > loadReportMaxAge {
+			continue
+		}
+		score := loadScore(load)
+		if score < bestScore {
+			best = load.MachineId
+			bestScore = score
+		}
+	}
+	return best
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"sync"
+	"time"
 
-	"github.com/hoyle1974/chorus/db"
 	"github.com/hoyle1974/chorus/dbx"
 	"github.com/hoyle1974/chorus/message"
 	"github.com/hoyle1974/chorus/misc"
@@ -23,24 +26,87 @@ type Room struct {
 	roomService *RoomService
 	logger      *slog.Logger
 	info        RoomInfo
-	consumer    *pubsub.Consumer
+	consumer    pubsub.Consumer
+	membersLock sync.Mutex
+	members     map[misc.ConnectionId]bool
+	storage     *roomStorage
+	isolate     *v8go.Isolate
 	ctx         *v8go.Context
+	faults      int
+	// offset in the topic of the next message, -1 until we have seen one
+	offset int64
+	// when our lease on the room runs out, only touched by renewLeases
+	leaseExpires time.Time
+
+	// Scripts only run on the room's goroutine, see timers.go
+	jobs        chan func()
+	done        chan struct{}
+	stopOnce    sync.Once
+	destroyOnce sync.Once
+	timers      map[int32]*roomTimer
+	nextTimerId int32
+	ticker      *time.Ticker
+	lastTick    time.Time
 }
 
+var errScriptTimeout = errors.New("script took too long")
+
 func (r *Room) AddMember(id misc.ConnectionId) {
-	r.roomService.AddMember(r.info.RoomId, id)
+	r.membersLock.Lock()
+	r.members[id] = true
+	r.membersLock.Unlock()
+	err := r.fenced(func(q dbx.QueriesX) error {
+		return q.AddRoomMember(context.Background(), r.info.RoomId, id)
+	})
+	if err != nil {
+		r.logger.Error("Could not add member", "memberId", id, "error", err)
+	}
 }
 
 func (r *Room) RemoveMember(id misc.ConnectionId) {
-	r.roomService.RemoveMember(r.info.RoomId, id)
+	r.membersLock.Lock()
+	delete(r.members, id)
+	r.membersLock.Unlock()
+	err := r.fenced(func(q dbx.QueriesX) error {
+		return q.RemoveRoomMember(context.Background(), r.info.RoomId, id)
+	})
+	if err != nil {
+		r.logger.Error("Could not remove member", "memberId", id, "error", err)
+	}
+}
+
+func (r *Room) memberCount() int {
+	r.membersLock.Lock()
+	defer r.membersLock.Unlock()
+	return len(r.members)
 }
 
 func (r *Room) Destroy() {
-	r.logger.Info("Deleting room")
-	r.roomService.DeleteRoom(r.info.RoomId)
+	r.destroyOnce.Do(func() {
+		r.logger.Info("Deleting room")
+		r.stop()
+		r.roomService.DeleteRoom(r)
+	})
+}
+
+// stop stops running the room on this machine without deleting it
+func (r *Room) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+		if r.consumer != nil {
+			r.consumer.Close()
+		}
+		r.roomService.lock.Lock()
+		delete(r.roomService.localRooms, r.info.RoomId)
+		r.roomService.lock.Unlock()
+	})
 }
 
 func (r *Room) OnMessageFromTopic(m pubsub.Message) {
+	r.OnMessageFromTopicAt(m, -1)
+}
+
+func (r *Room) OnMessageFromTopicAt(m pubsub.Message, offset int64) {
 	msg := m.(*message.Message)
 
 	r.logger.Info("Room.OnMessageFromTopic", "msg", msg)
@@ -50,6 +116,9 @@ func (r *Room) OnMessageFromTopic(m pubsub.Message) {
 		r.logger.Error("Received an error for the wrong room", "targetRoomId", msg.RoomId)
 		return
 	}
+	if !r.checkEpoch(msg) {
+		return
+	}
 
 	if msg.Cmd == "Pong" {
 		r.logger.Debug("Pong", "memberId", msg.SenderId)
@@ -64,8 +133,89 @@ func (r *Room) OnMessageFromTopic(m pubsub.Message) {
 		r.RemoveMember(misc.ConnectionId(msg.SenderId))
 	}
 
-	r.callJSOnMessage(msg)
+	r.do(func() {
+		if offset >= 0 {
+			r.offset = offset + 1
+		}
+		r.scriptError(r.callJSOnMessage(msg))
+	})
+}
+
+func (r *Room) scriptError(err error) {
+	if errors.Is(err, errScriptTimeout) {
+		r.fault(err)
+	}
+}
+
+// fault tells the room its script was terminated, and destroys the room when
+// that keeps happening
+func (r *Room) fault(err error) {
+	r.faults++
+	scriptFaults.WithLabelValues(r.info.AdminScript).Inc()
+	r.logger.Warn("Room script terminated", "error", err, "faults", r.faults)
+
+	r.send(message.NewErrorMessage(r.info.RoomId, r.info.RoomId.ListenerId(), err))
 
+	if r.faults >= r.state.rooms.MaxScriptFaults {
+		roomsFaulted.WithLabelValues(r.info.AdminScript).Inc()
+		r.logger.Error("Room faulted, destroying it", "script", r.info.AdminScript, "faults", r.faults, "error", err)
+		r.Destroy()
+	}
+}
+
+// runScript runs source in the room's context, terminating it if it runs past
+// the script deadline
+func (r *Room) runScript(source string, origin string) (*v8go.Value, error) {
+	return r.callScript(origin, func() (*v8go.Value, error) {
+		return r.ctx.RunScript(source, origin)
+	})
+}
+
+// callScript is how the room enters its script.  The call is terminated if
+// it runs past the script deadline.  What it put in storage is saved after if it
+// returned normally, and undone if it threw or was terminated.
+func (r *Room) callScript(origin string, call func() (*v8go.Value, error)) (*v8go.Value, error) {
+	// The deadline only terminates the call while it is running, a timer
+	// firing as it returns must not terminate whatever runs next
+	var lock sync.Mutex
+	running, timedOut := true, false
+	deadline := r.state.rooms.ScriptDeadline
+	timer := time.AfterFunc(deadline, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if running {
+			timedOut = true
+			r.isolate.TerminateExecution()
+		}
+	})
+	start := time.Now()
+	value, err := call()
+	lock.Lock()
+	running = false
+	lock.Unlock()
+	timer.Stop()
+	r.roomService.scriptTime.Add(int64(time.Since(start)))
+
+	if r.storage != nil {
+		if err != nil || timedOut {
+			r.storage.rollback()
+		} else {
+			r.storage.keep()
+		}
+	}
+	if r.storage != nil && r.storage.dirty() {
+		flushErr := r.fenced(r.storage.flush)
+		if flushErr != nil {
+			r.logger.Error("Could not save room storage", "error", flushErr)
+		} else {
+			r.storage.saved()
+		}
+	}
+
+	if timedOut {
+		return nil, fmt.Errorf("%w: %s ran for more than %v", errScriptTimeout, origin, deadline)
+	}
+	return value, err
 }
 
 func (r *Room) callJSOnMessage(msg *message.Message) error {
@@ -75,7 +225,15 @@ func (r *Room) callJSOnMessage(msg *message.Message) error {
 	}
 	cmd := "on" + msg.Cmd + "(JSON.parse(msg))"
 	// fmt.Printf("@@@ %s : Running: %v\n", r.script, cmd)
-	_, err = r.ctx.RunScript(cmd, "")
+	start := time.Now()
+	_, err = r.runScript(cmd, "on"+msg.Cmd)
+	result := "ok"
+	if errors.Is(err, errScriptTimeout) {
+		result = "timeout"
+	} else if err != nil {
+		result = "error"
+	}
+	handlerSeconds.WithLabelValues(r.info.AdminScript, result).Observe(time.Since(start).Seconds())
 	if err != nil {
 		// fmt.Println("@@@ %s : %v", r.script, err)
 		return err
@@ -86,6 +244,7 @@ func (r *Room) callJSOnMessage(msg *message.Message) error {
 func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8go.Context, error) {
 	// Create a new Isolate for sandboxed execution
 	isolate := v8go.NewIsolate()
+	room.isolate = isolate
 
 	data, err := os.ReadFile(adminScriptFilename)
 	if err != nil {
@@ -98,7 +257,7 @@ func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8
 
 	// create global endRoom() in JS context
 	endRoom := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
-		// TODO EndRoom(room.RoomId)
+		room.Destroy()
 		return nil
 	})
 	err = global.Set("endRoom", endRoom)
@@ -117,7 +276,7 @@ func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8
 		msg := message.NewMessageFromString(jsonString)
 		msg.RoomId = room.info.RoomId
 		msg.SenderId = room.info.RoomId.ListenerId()
-		pubsub.SendMessage(&msg)
+		room.send(msg)
 
 		return nil // you can return a value back to the JS caller if required
 	})
@@ -149,12 +308,12 @@ func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8
 			DestroyOnOrphan: true,
 		}
 
-		newRoom, err := room.roomService.NewRoom(roomInfo)
+		roomId, err := room.roomService.NewRoom(roomInfo)
 		if err != nil {
 			room.logger.Error("NewRoom", "error", err)
 			return nil
 		}
-		objTemplate := newRoom.JSTemplate(isolate)
+		objTemplate := roomHandle(isolate, room.state, room.logger, roomId)
 
 		obj, err := objTemplate.NewInstance(info.Context())
 		if err != nil {
@@ -184,10 +343,20 @@ func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8
 		return nil, fmt.Errorf("create thisRoom function: %w", err)
 	}
 
+	err = addTimerFunctions(room, isolate, global)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addStorageObject(room, isolate, global)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx := v8go.NewContext(isolate, global) // new Context with the global Object set to our object template
 	room.ctx = ctx
 
-	_, err = ctx.RunScript(content, adminScriptFilename)
+	_, err = room.runScript(content, adminScriptFilename)
 
 	if err != nil {
 		return nil, fmt.Errorf("runScript(%s): %w", adminScriptFilename, err)
@@ -197,31 +366,52 @@ func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8
 }
 
 func (r *Room) JSTemplate(isolate *v8go.Isolate) *v8go.ObjectTemplate {
+	return roomHandle(isolate, r.state, r.logger, r.info.RoomId)
+}
+
+// roomHandle is what scripts get back from newRoom() and thisRoom().  It only
+// needs the room's id, so it works the same whichever machine runs the room.
+func roomHandle(isolate *v8go.Isolate, state GlobalServerState, logger *slog.Logger, roomId misc.RoomId) *v8go.ObjectTemplate {
 	// Create a new java object that represents a room
 	objTemplate := v8go.NewObjectTemplate(isolate)
-	objTemplate.Set("Id", r.info.RoomId)
-	objTemplate.Set("Room", r)
+	objTemplate.Set("Id", string(roomId))
 
 	join := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
 		id := misc.ConnectionId(info.Args()[0].String())
 
-		q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-		mid := q.FindMachine(id)
+		q := state.database.Queries()
+		mid := q.FindMachine(context.Background(), id)
 
 		fmt.Println("Looked up", id, " and found on ", mid)
+		if mid == misc.NilMachineId {
+			// Detached connections have no machine to tell
+			logger.Warn("Connection is not on any machine", "connectionId", id)
+			return nil
+		}
 
 		// What EUS is that client on?
-		cmd := message.NewClientCmd(mid, id.ListenerId(), "ClientJoin", map[string]interface{}{"RoomId": r.info.RoomId})
+		cmd := message.NewClientCmd(mid, id.ListenerId(), "ClientJoin", map[string]interface{}{"RoomId": roomId})
 		fmt.Println("Create ", cmd)
-		pubsub.SendMessage(&cmd)
+		state.bus.SendMessage(&cmd)
 
 		return nil
 	})
 	objTemplate.Set("Join", join)
 
 	leave := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
-		//id := misc.ListenerId(info.Args()[0].String())
-		// TODO Leave(r.RoomId, misc.ListenerId(id))
+		id := misc.ConnectionId(info.Args()[0].String())
+
+		q := state.database.Queries()
+		mid := q.FindMachine(context.Background(), id)
+		if mid == misc.NilMachineId {
+			logger.Warn("Connection is not on any machine", "connectionId", id)
+			return nil
+		}
+
+		// Tell the client's EUS to take it out of the room
+		cmd := message.NewClientCmd(mid, id.ListenerId(), "ClientLeave", map[string]interface{}{"RoomId": roomId})
+		state.bus.SendMessage(&cmd)
+
 		return nil
 	})
 	objTemplate.Set("Leave", leave)
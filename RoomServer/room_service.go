@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hoyle1974/chorus/db"
 	"github.com/hoyle1974/chorus/dbx"
 	"github.com/hoyle1974/chorus/message"
 	"github.com/hoyle1974/chorus/misc"
@@ -19,6 +22,7 @@ type RoomInfo struct {
 	Name            string
 	AdminScript     string
 	DestroyOnOrphan bool
+	Epoch           int64 // which owner of the room this is, see lease.go
 }
 
 func (r RoomInfo) String() string {
@@ -40,44 +44,77 @@ func NewRoomInfoFromString(s string) RoomInfo {
 
 type RoomService struct {
 	state      GlobalServerState
+	roomCmds   pubsub.Consumer
+	draining   atomic.Bool
+	scriptTime atomic.Int64 // nanoseconds spent in scripts since the last load report
+	lock       sync.Mutex
 	localRooms map[misc.RoomId]*Room
+	handoffs   map[misc.RoomId]chan struct{} // rooms we are waiting on another machine to adopt
 }
 
-func (rs *RoomService) AddMember(roomId misc.RoomId, connectionId misc.ConnectionId) {
-	q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-	q.AddRoomMember(roomId, connectionId)
+// rooms are the rooms running on this machine
+func (rs *RoomService) rooms() []*Room {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	rooms := []*Room{}
+	for _, r := range rs.localRooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
 }
 
-func (rs *RoomService) RemoveMember(roomId misc.RoomId, connectionId misc.ConnectionId) {
-	q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-	q.RemoveRoomMember(roomId, connectionId)
+func (rs *RoomService) isLocal(roomId misc.RoomId) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	_, ok := rs.localRooms[roomId]
+	return ok
 }
 
-func (rs *RoomService) DeleteRoom(roomId misc.RoomId) {
-	q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-	members, err := q.GetRoomMembers(roomId)
+// DeleteRoom deletes one of our rooms along with its members and data.  A
+// room that has moved to another machine is left alone.
+func (rs *RoomService) DeleteRoom(r *Room) {
+	rs.lock.Lock()
+	delete(rs.localRooms, r.info.RoomId)
+	rs.lock.Unlock()
+
+	err := r.fenced(func(q dbx.QueriesX) error {
+		return q.DeleteRoom(context.Background(), r.info.RoomId)
+	})
 	if err != nil {
-		for _, member := range members {
-			rs.RemoveMember(roomId, member)
-		}
+		rs.state.logger.Error("Could not delete room", "roomId", r.info.RoomId, "error", err)
+		return
 	}
-	pubsub.DeleteTopic(roomId.Topic())
+	rs.state.bus.DeleteTopic(r.info.RoomId.Topic())
+}
+
+func (rs *RoomService) Destroy() {
+	rs.roomCmds.Close()
+	rs.state.bus.DeleteTopic(rs.state.machineId.RoomCmdTopic())
 }
 
 func StartLocalRoomService(state GlobalServerState) *RoomService {
 	rs := &RoomService{
 		state:      state,
 		localRooms: map[misc.RoomId]*Room{},
+		handoffs:   map[misc.RoomId]chan struct{}{},
 	}
 
+	state.bus.CreateTopic(state.machineId.RoomCmdTopic())
+	rs.roomCmds = state.bus.NewConsumer(state.logger, string(state.machineId), state.machineId.RoomCmdTopic(), rs)
+	rs.roomCmds.StartConsumer(&message.RoomCmd{})
+	go rs.reportLoad()
+	go rs.renewLeases()
+	registerRoomMetrics(rs)
+
 	state.logger.Info("Local Room Service is started.")
 	return rs
 }
 
 func (rs *RoomService) RoomServiceProcess() {
 	for {
-		q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-		rooms, err := q.GetOrphanedRooms()
+		q := rs.state.database.Queries()
+		rooms, err := q.GetOrphanedRooms(context.Background(), rs.state.liveness.MachineExpiry)
 		if err != nil {
 			rs.state.logger.Error("Could not get rooms", "error", err)
 			return
@@ -112,15 +149,41 @@ func (rs *RoomService) BootstrapLobby() bool {
 	return err == nil
 }
 
-func (rs *RoomService) NewRoom(info RoomInfo) (*Room, error) {
+// NewRoom creates a room on whichever RoomServer placeRoom picks
+func (rs *RoomService) NewRoom(info RoomInfo) (misc.RoomId, error) {
 	rs.state.logger.Debug("NewRoom", "info", info)
-	q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-	err := q.CreateRoom(info.RoomId, rs.state.MachineId(), info.Name, info.AdminScript, info.DestroyOnOrphan)
+	if rs.draining.Load() {
+		return "", errDraining
+	}
+
+	target := rs.placeRoom()
+	err := rs.state.database.WithTx(context.Background(), func(q dbx.QueriesX) error {
+		err := q.CreateRoom(context.Background(), info.RoomId, target, info.Name, info.AdminScript, info.DestroyOnOrphan, rs.state.liveness.RoomLease)
+		if err != nil || target == rs.state.machineId {
+			return err
+		}
+		// The other machine binds the room after we return and the script
+		// starts sending it messages, so it reads the topic from the start
+		return q.SaveRoomSnapshot(context.Background(), info.RoomId, noSnapshotState, -1)
+	})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	pubsub.CreateTopic(info.RoomId.Topic())
-	return rs.bindRoomToThisMachine(info), nil
+	info.Epoch = 1
+	rs.state.bus.CreateTopic(info.RoomId.Topic())
+
+	if target == rs.state.machineId {
+		if rs.bindRoomToThisMachine(info) == nil {
+			return "", errors.New("could not start room")
+		}
+		return info.RoomId, nil
+	}
+
+	rs.state.logger.Info("Placing room", "roomId", info.RoomId, "target", target)
+	cmd := message.NewRoomCmd(target, rs.state.machineId, info.RoomId, cmdCreateRoom, nil)
+	rs.state.bus.SendMessage(&cmd)
+
+	return info.RoomId, nil
 }
 
 // We are the owner, but we need to bind a local struct to the
@@ -129,26 +192,53 @@ func (rs *RoomService) bindRoomToThisMachine(info RoomInfo) *Room {
 	rs.state.logger.Debug("Binding locally", "roomId", info.RoomId)
 
 	r := &Room{
-		state:       rs.state,
-		roomService: rs,
-		info:        info,
-		logger:      rs.state.logger.With("info", info),
+		state:        rs.state,
+		roomService:  rs,
+		info:         info,
+		logger:       rs.state.logger.With("info", info),
+		offset:       -1,
+		leaseExpires: time.Now().Add(rs.state.liveness.RoomLease),
+		members:      map[misc.ConnectionId]bool{},
+		jobs:         make(chan func()),
+		done:         make(chan struct{}),
+		timers:       map[int32]*roomTimer{},
+	}
+
+	storage, err := loadRoomStorage(rs.state.database.Queries(), info.RoomId)
+	if err != nil {
+		rs.state.logger.Error("loadRoomStorage", "error", err)
+		return nil
 	}
+	r.storage = storage
 
 	ctx, err := createScriptEnvironmentForRoom(r, info.AdminScript)
 	if err != nil {
 		rs.state.logger.Error("createScriptEnvironmentForRoom", "error", err)
+		close(r.done)
+		r.stopTimers()
+		r.disposeScript()
 		return nil
 	}
 	r.ctx = ctx
 
-	r.consumer = pubsub.NewConsumer(r.logger, string(rs.state.machineId), info.RoomId.Topic(), r)
+	snap, ok := r.loadSnapshot()
+	if ok {
+		// Pick up where the last owner left off
+		r.restore(snap)
+		r.consumer = rs.state.bus.NewConsumerAt(r.logger, info.RoomId.Topic(), snap.Offset, r)
+	} else {
+		r.consumer = rs.state.bus.NewConsumer(r.logger, string(rs.state.machineId), info.RoomId.Topic(), r)
+	}
+	go r.run()
 	r.consumer.StartConsumer(&message.Message{})
+
+	rs.lock.Lock()
+	rs.localRooms[info.RoomId] = r
+	rs.lock.Unlock()
 	time.Sleep(time.Duration(1) * time.Second)
 
 	// Ask anyone in the room to respond
-	msg := message.NewMessage(info.RoomId, info.RoomId.ListenerId(), "", "Ping", map[string]interface{}{})
-	pubsub.SendMessage(&msg)
+	r.send(message.NewMessage(info.RoomId, info.RoomId.ListenerId(), "", "Ping", map[string]interface{}{}))
 
 	return r
 }
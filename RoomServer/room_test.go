@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/chorus/config"
+	"rogchap.com/v8go"
+)
+
+// newTestScriptRoom is a room with a bare script context and no storage
+func newTestScriptRoom(t *testing.T, deadline time.Duration) *Room {
+	t.Helper()
+	state := GlobalServerState{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rooms:  config.Rooms{ScriptDeadline: deadline, MaxScriptFaults: 3},
+	}
+	r := &Room{state: state, roomService: &RoomService{state: state}, logger: state.logger}
+	r.isolate = v8go.NewIsolate()
+	r.ctx = v8go.NewContext(r.isolate)
+	t.Cleanup(r.disposeScript)
+	return r
+}
+
+func TestCallScriptDeadline(t *testing.T) {
+	r := newTestScriptRoom(t, 50*time.Millisecond)
+
+	_, err := r.runScript("for (;;) {}", "spin")
+	if !errors.Is(err, errScriptTimeout) {
+		t.Fatalf("err = %v, want errScriptTimeout", err)
+	}
+
+	// Nothing is left over to terminate the next call
+	value, err := r.runScript("1 + 1", "add")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	if value.Integer() != 2 {
+		t.Errorf("value = %v", value)
+	}
+}
+
+func TestCallScriptFinishingAtTheDeadline(t *testing.T) {
+	r := newTestScriptRoom(t, time.Millisecond)
+
+	// Calls that finish around the deadline are either fine or timed out,
+	// never a termination landing on the call after
+	for i := 0; i < 200; i++ {
+		_, err := r.callScript("sleep", func() (*v8go.Value, error) {
+			time.Sleep(time.Millisecond)
+			return nil, nil
+		})
+		if err != nil && !errors.Is(err, errScriptTimeout) {
+			t.Fatalf("err = %v", err)
+		}
+		_, err = r.runScript("1", "next")
+		if err != nil && !errors.Is(err, errScriptTimeout) {
+			t.Fatalf("next call failed: %v", err)
+		}
+	}
+}
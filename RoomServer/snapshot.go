@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/hoyle1974/chorus/misc"
+	"rogchap.com/v8go"
+)
+
+// A room script can keep its state across a failover by defining
+//
+//	function onSnapshot() { return {board: board, turn: turn} }
+//	function onRestore(state) { board = state.board; turn = state.turn }
+//
+// Snapshots are taken every snapshotInterval and when the RoomServer shuts
+// down.  The machine that takes the room over calls onRestore with the
+// latest one and then replays the room's messages that came after it, so
+// anything the handlers sent the first time around is sent again.
+
+const snapshotInterval = time.Duration(10) * time.Second
+
+func (r *Room) scriptFunction(name string) (*v8go.Function, bool) {
+	value, err := r.ctx.Global().Get(name)
+	if err != nil || !value.IsFunction() {
+		return nil, false
+	}
+	fn, err := value.AsFunction()
+	if err != nil {
+		return nil, false
+	}
+	return fn, true
+}
+
+// snapshot saves what onSnapshot returns, it runs on the room's goroutine
+func (r *Room) snapshot() {
+	state, ok := r.scriptState()
+	if ok {
+		r.saveSnapshot(state)
+	}
+}
+
+// handOff snapshots the room and makes target its owner in one transaction,
+// so the new owner can't start from an older snapshot.  Rooms without
+// onSnapshot still record where they got to so the new owner doesn't miss
+// anything.
+func (r *Room) handOff(target misc.MachineId) error {
+	state, ok := r.scriptState()
+	if !ok {
+		state = noSnapshotState
+	}
+	return r.fenced(func(q dbx.QueriesX) error {
+		err := q.SaveRoomSnapshot(context.Background(), r.info.RoomId, state, r.offset)
+		if err != nil {
+			return err
+		}
+		_, err = q.SetRoomOwner(context.Background(), r.info.RoomId, r.state.machineId, target, r.state.liveness.RoomLease)
+		return err
+	})
+}
+
+// noSnapshotState marks a snapshot that only holds an offset
+const noSnapshotState = "null"
+
+func (r *Room) scriptState() (string, bool) {
+	onSnapshot, ok := r.scriptFunction("onSnapshot")
+	if !ok {
+		return "", false
+	}
+	value, err := r.callScript("onSnapshot", func() (*v8go.Value, error) {
+		return onSnapshot.Call(v8go.Undefined(r.isolate))
+	})
+	if err != nil {
+		r.logger.Error("onSnapshot", "error", err)
+		r.scriptError(err)
+		return "", false
+	}
+	state, err := v8go.JSONStringify(r.ctx, value)
+	if err != nil {
+		r.logger.Error("onSnapshot returned something that isn't JSON", "error", err)
+		return "", false
+	}
+	return state, true
+}
+
+func (r *Room) saveSnapshot(state string) {
+	err := r.fenced(func(q dbx.QueriesX) error {
+		return q.SaveRoomSnapshot(context.Background(), r.info.RoomId, state, r.offset)
+	})
+	if err != nil {
+		r.logger.Error("Could not save snapshot", "error", err)
+	}
+}
+
+// loadSnapshot returns the room's latest snapshot, if it has one
+func (r *Room) loadSnapshot() (dbx.RoomSnapshot, bool) {
+	q := r.roomService.state.database.Queries()
+	snap, err := q.GetRoomSnapshot(context.Background(), r.info.RoomId)
+	if errors.Is(err, dbx.ErrNotFound) {
+		return snap, false
+	}
+	if err != nil {
+		r.logger.Error("Could not load snapshot, starting fresh", "error", err)
+		return snap, false
+	}
+	return snap, true
+}
+
+// restore hands a snapshot to onRestore, it runs before the room's goroutine
+// is started
+func (r *Room) restore(snap dbx.RoomSnapshot) {
+	r.offset = snap.Offset
+
+	if snap.State == noSnapshotState {
+		// Only there to tell us where to start, a later failover shouldn't
+		// replay from it
+		q := r.roomService.state.database.Queries()
+		err := q.DeleteRoomSnapshot(context.Background(), r.info.RoomId)
+		if err != nil {
+			r.logger.Error("Could not delete handoff snapshot", "error", err)
+		}
+		return
+	}
+
+	onRestore, ok := r.scriptFunction("onRestore")
+	if !ok {
+		r.logger.Warn("Room has a snapshot but no onRestore")
+		return
+	}
+	state, err := v8go.JSONParse(r.ctx, snap.State)
+	if err != nil {
+		r.logger.Error("Could not parse snapshot", "error", err)
+		return
+	}
+	_, err = r.callScript("onRestore", func() (*v8go.Value, error) {
+		return onRestore.Call(v8go.Undefined(r.isolate), state)
+	})
+	if err != nil {
+		r.logger.Error("onRestore", "error", err)
+	}
+}
+
+// SnapshotRooms snapshots every room on this machine, for a graceful shutdown
+func (rs *RoomService) SnapshotRooms() {
+	for _, r := range rs.rooms() {
+		r.do(r.snapshot)
+	}
+}
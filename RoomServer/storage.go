@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/hoyle1974/chorus/misc"
+	"rogchap.com/v8go"
+)
+
+// roomStorage backs the storage global in room scripts
+//
+//	storage.set(key, value) - value is anything JSON.stringify can handle
+//	storage.get(key)        - undefined when the key isn't set
+//	storage.delete(key)
+//	storage.list()          - all the keys
+//
+// Everything is kept in the room_data table so a room that is bound on
+// another machine picks up where it left off.  Reads come from memory, and
+// the writes a handler makes are saved together when it returns.  A handler
+// that throws or times out has its writes undone instead.
+type roomStorage struct {
+	roomId  misc.RoomId
+	values  map[string]string
+	pending map[string]*string // nil means delete
+	touched map[string]keyBefore
+}
+
+// keyBefore is how a key was before the running handler first changed it
+type keyBefore struct {
+	value      *string // nil if it wasn't set
+	pending    *string
+	wasPending bool
+}
+
+func loadRoomStorage(q dbx.QueriesX, roomId misc.RoomId) (*roomStorage, error) {
+	values, err := q.GetRoomData(context.Background(), roomId)
+	if err != nil {
+		return nil, fmt.Errorf("load room data: %w", err)
+	}
+	return &roomStorage{roomId: roomId, values: values, pending: map[string]*string{}, touched: map[string]keyBefore{}}, nil
+}
+
+func (s *roomStorage) set(key string, value string) {
+	s.touch(key)
+	s.values[key] = value
+	s.pending[key] = &value
+}
+
+func (s *roomStorage) delete(key string) {
+	s.touch(key)
+	delete(s.values, key)
+	s.pending[key] = nil
+}
+
+func (s *roomStorage) touch(key string) {
+	if _, ok := s.touched[key]; ok {
+		return
+	}
+	before := keyBefore{}
+	if value, ok := s.values[key]; ok {
+		before.value = &value
+	}
+	before.pending, before.wasPending = s.pending[key]
+	s.touched[key] = before
+}
+
+// keep accepts what the handler that just returned changed
+func (s *roomStorage) keep() {
+	s.touched = map[string]keyBefore{}
+}
+
+// rollback undoes what the handler that just returned changed, writes kept
+// from earlier handlers are left pending
+func (s *roomStorage) rollback() {
+	for key, before := range s.touched {
+		if before.value == nil {
+			delete(s.values, key)
+		} else {
+			s.values[key] = *before.value
+		}
+		if before.wasPending {
+			s.pending[key] = before.pending
+		} else {
+			delete(s.pending, key)
+		}
+	}
+	s.keep()
+}
+
+func (s *roomStorage) dirty() bool {
+	return len(s.pending) > 0
+}
+
+// flush writes the pending writes with q, the room runs it in a fenced
+// transaction.  If that fails they are kept and tried again after the next
+// handler.
+func (s *roomStorage) flush(q dbx.QueriesX) error {
+	for key, value := range s.pending {
+		var err error
+		if value == nil {
+			err = q.DeleteRoomData(context.Background(), s.roomId, key)
+		} else {
+			err = q.SetRoomData(context.Background(), s.roomId, key, *value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saved forgets the pending writes once they are committed
+func (s *roomStorage) saved() {
+	s.pending = map[string]*string{}
+}
+
+func addStorageObject(room *Room, isolate *v8go.Isolate, global *v8go.ObjectTemplate) error {
+	storage := v8go.NewObjectTemplate(isolate)
+
+	get := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		if len(info.Args()) < 1 {
+			return nil
+		}
+		value, ok := room.storage.values[info.Args()[0].String()]
+		if !ok {
+			return nil
+		}
+		ret, err := v8go.JSONParse(info.Context(), value)
+		if err != nil {
+			room.logger.Error("storage.get", "error", err)
+			return nil
+		}
+		return ret
+	})
+
+	set := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		if len(info.Args()) < 2 {
+			room.logger.Error("storage.set needs a key and a value")
+			return nil
+		}
+		value, err := v8go.JSONStringify(info.Context(), info.Args()[1])
+		if err != nil {
+			room.logger.Error("storage.set", "error", err)
+			return nil
+		}
+		room.storage.set(info.Args()[0].String(), value)
+		return nil
+	})
+
+	del := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		if len(info.Args()) > 0 {
+			room.storage.delete(info.Args()[0].String())
+		}
+		return nil
+	})
+
+	list := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		keys := []string{}
+		for key := range room.storage.values {
+			keys = append(keys, key)
+		}
+		b, _ := json.Marshal(keys)
+		ret, err := v8go.JSONParse(info.Context(), string(b))
+		if err != nil {
+			room.logger.Error("storage.list", "error", err)
+			return nil
+		}
+		return ret
+	})
+
+	functions := map[string]*v8go.FunctionTemplate{
+		"get":    get,
+		"set":    set,
+		"delete": del,
+		"list":   list,
+	}
+	for name, fn := range functions {
+		err := storage.Set(name, fn)
+		if err != nil {
+			return fmt.Errorf("create storage.%s function: %w", name, err)
+		}
+	}
+	err := global.Set("storage", storage)
+	if err != nil {
+		return fmt.Errorf("create storage object: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func newTestStorage() *roomStorage {
+	return &roomStorage{
+		roomId:  "R1",
+		values:  map[string]string{"a": "1", "b": "2"},
+		pending: map[string]*string{},
+		touched: map[string]keyBefore{},
+	}
+}
+
+func TestRoomStorageRollback(t *testing.T) {
+	tests := []struct {
+		name        string
+		earlier     func(s *roomStorage) // a handler that returned normally, not saved yet
+		handler     func(s *roomStorage)
+		wantValues  map[string]string
+		wantPending map[string]string // "" for a pending delete
+	}{
+		{
+			name: "new, changed and deleted keys",
+			handler: func(s *roomStorage) {
+				s.set("a", "changed")
+				s.delete("b")
+				s.set("c", "new")
+			},
+			wantValues:  map[string]string{"a": "1", "b": "2"},
+			wantPending: map[string]string{},
+		},
+		{
+			name: "a key changed more than once",
+			handler: func(s *roomStorage) {
+				s.set("a", "x")
+				s.delete("a")
+				s.set("a", "y")
+			},
+			wantValues:  map[string]string{"a": "1", "b": "2"},
+			wantPending: map[string]string{},
+		},
+		{
+			name: "writes from an earlier handler stay pending",
+			earlier: func(s *roomStorage) {
+				s.set("a", "earlier")
+				s.delete("b")
+			},
+			handler: func(s *roomStorage) {
+				s.set("a", "failed")
+				s.set("b", "failed")
+			},
+			wantValues:  map[string]string{"a": "earlier"},
+			wantPending: map[string]string{"a": "earlier", "b": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStorage()
+			if tt.earlier != nil {
+				tt.earlier(s)
+				s.keep()
+			}
+
+			tt.handler(s)
+			s.rollback()
+
+			if !maps.Equal(s.values, tt.wantValues) {
+				t.Errorf("values = %v, want %v", s.values, tt.wantValues)
+			}
+			pending := map[string]string{}
+			for key, value := range s.pending {
+				pending[key] = ""
+				if value != nil {
+					pending[key] = *value
+				}
+			}
+			if !maps.Equal(pending, tt.wantPending) {
+				t.Errorf("pending = %v, want %v", pending, tt.wantPending)
+			}
+			if len(s.touched) != 0 {
+				t.Errorf("touched = %v after rollback", s.touched)
+			}
+		})
+	}
+}
@@ -108,6 +108,18 @@ function onLeave(msg) {
     }
 }
 
+function onSnapshot() {
+    return {xUser:xUser, oUser:oUser, board:board, ready:ready, turn:turn}
+}
+
+function onRestore(state) {
+    xUser = state.xUser
+    oUser = state.oUser
+    board = state.board
+    ready = state.ready
+    turn = state.turn
+}
+
 function onRoomEmpty() {
     log("Room is empty, ending the room")
     endRoom()
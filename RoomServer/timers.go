@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"rogchap.com/v8go"
+)
+
+// Everything a room's script does happens on the room's own goroutine, one
+// thing at a time: message handlers, timers, ticks and snapshots.  Scripts can use
+//
+//	setTimeout(fn, ms) / clearTimeout(id)
+//	setInterval(fn, ms) / clearInterval(id)
+//	setTickInterval(ms) - call onTick(dt) every ms, 0 turns it off
+//
+// All of it stops when the room ends.
+
+type roomTimer struct {
+	timer    *time.Timer
+	fn       *v8go.Function
+	interval time.Duration
+	repeat   bool
+}
+
+// run is the room's goroutine, it owns the script, timers and ticker.  The
+// script is disposed of when the room stops, after its last job.
+func (r *Room) run() {
+	defer r.disposeScript()
+	defer r.stopTimers()
+
+	snapshots := time.NewTicker(snapshotInterval)
+	defer snapshots.Stop()
+
+	for {
+		var tickC <-chan time.Time
+		if r.ticker != nil {
+			tickC = r.ticker.C
+		}
+
+		select {
+		case <-r.done:
+			return
+		case job := <-r.jobs:
+			job()
+		case now := <-tickC:
+			r.tick(now)
+		case <-snapshots.C:
+			r.snapshot()
+		}
+	}
+}
+
+// post queues job to run on the room's goroutine
+func (r *Room) post(job func()) {
+	select {
+	case r.jobs <- job:
+	case <-r.done:
+	}
+}
+
+// do runs job on the room's goroutine and waits for it to finish
+func (r *Room) do(job func()) {
+	finished := make(chan struct{})
+	r.post(func() {
+		defer close(finished)
+		job()
+	})
+	select {
+	case <-finished:
+	case <-r.done:
+	}
+}
+
+// disposeScript frees the room's V8 isolate, nothing can run on it after
+func (r *Room) disposeScript() {
+	if r.ctx != nil {
+		r.ctx.Close()
+	}
+	if r.isolate != nil {
+		r.isolate.Dispose()
+	}
+}
+
+func (r *Room) stopTimers() {
+	for id, t := range r.timers {
+		t.timer.Stop()
+		delete(r.timers, id)
+	}
+	if r.ticker != nil {
+		r.ticker.Stop()
+		r.ticker = nil
+	}
+}
+
+func (r *Room) addTimer(fn *v8go.Function, interval time.Duration, repeat bool) int32 {
+	r.nextTimerId++
+	id := r.nextTimerId
+	t := &roomTimer{fn: fn, interval: interval, repeat: repeat}
+	t.timer = time.AfterFunc(interval, func() {
+		r.post(func() { r.fireTimer(id) })
+	})
+	r.timers[id] = t
+	return id
+}
+
+func (r *Room) clearTimer(id int32) {
+	t, ok := r.timers[id]
+	if ok {
+		t.timer.Stop()
+		delete(r.timers, id)
+	}
+}
+
+func (r *Room) fireTimer(id int32) {
+	t, ok := r.timers[id]
+	if !ok {
+		// Cleared after it went off
+		return
+	}
+	if t.repeat {
+		t.timer.Reset(t.interval)
+	} else {
+		delete(r.timers, id)
+	}
+
+	_, err := r.callScript("timer", func() (*v8go.Value, error) {
+		return t.fn.Call(v8go.Undefined(r.isolate))
+	})
+	r.scriptError(err)
+}
+
+func (r *Room) setTickInterval(interval time.Duration) {
+	if r.ticker != nil {
+		r.ticker.Stop()
+		r.ticker = nil
+	}
+	if interval > 0 {
+		r.ticker = time.NewTicker(interval)
+		r.lastTick = time.Now()
+	}
+}
+
+func (r *Room) tick(now time.Time) {
+	dt := now.Sub(r.lastTick)
+	r.lastTick = now
+
+	fn, ok := r.scriptFunction("onTick")
+	if !ok {
+		return
+	}
+	arg, err := v8go.NewValue(r.isolate, float64(dt.Milliseconds()))
+	if err != nil {
+		return
+	}
+	_, err = r.callScript("onTick", func() (*v8go.Value, error) {
+		return fn.Call(v8go.Undefined(r.isolate), arg)
+	})
+	r.scriptError(err)
+}
+
+func addTimerFunctions(room *Room, isolate *v8go.Isolate, global *v8go.ObjectTemplate) error {
+	timerFunc := func(repeat bool) *v8go.FunctionTemplate {
+		return v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+			args := info.Args()
+			if len(args) < 1 || !args[0].IsFunction() {
+				room.logger.Error("timer needs a function")
+				return nil
+			}
+			fn, err := args[0].AsFunction()
+			if err != nil {
+				room.logger.Error("timer function", "error", err)
+				return nil
+			}
+			interval := time.Duration(0)
+			if len(args) > 1 {
+				interval = time.Duration(args[1].Integer()) * time.Millisecond
+			}
+			if repeat && interval <= 0 {
+				// An interval of nothing would spin the room
+				interval = time.Millisecond
+			}
+
+			id, err := v8go.NewValue(isolate, room.addTimer(fn, interval, repeat))
+			if err != nil {
+				return nil
+			}
+			return id
+		})
+	}
+	clearFunc := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		if len(info.Args()) > 0 {
+			room.clearTimer(info.Args()[0].Int32())
+		}
+		return nil
+	})
+	setTickInterval := v8go.NewFunctionTemplate(isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		if len(info.Args()) > 0 {
+			room.setTickInterval(time.Duration(info.Args()[0].Integer()) * time.Millisecond)
+		}
+		return nil
+	})
+
+	functions := map[string]*v8go.FunctionTemplate{
+		"setTimeout":      timerFunc(false),
+		"setInterval":     timerFunc(true),
+		"clearTimeout":    clearFunc,
+		"clearInterval":   clearFunc,
+		"setTickInterval": setTickInterval,
+	}
+	for name, fn := range functions {
+		err := global.Set(name, fn)
+		if err != nil {
+			return fmt.Errorf("create %s function: %w", name, err)
+		}
+	}
+	return nil
+}
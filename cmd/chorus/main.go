@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/charmbracelet/log"
+	"github.com/hoyle1974/chorus/config"
+	"github.com/hoyle1974/chorus/db/migrations"
+	"github.com/hoyle1974/chorus/dbx"
+)
+
+const usage = `usage: chorus <command> [flags]
+
+commands:
+  migrate   bring the database schema up to date
+  version   print the schema version this build expects
+
+The flags are the same as the servers', see chorus migrate -h`
+
+func main() {
+	handler := log.NewWithOptions(os.Stderr, log.Options{Level: log.InfoLevel})
+	logger := slog.New(handler)
+
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "migrate":
+		cfg, err := config.Load(os.Args[2:])
+		if err != nil {
+			logger.Error("Bad config", "error", err)
+			os.Exit(2)
+		}
+		dbx.Configure(cfg.Database)
+
+		err = dbx.Migrate(context.Background(), logger)
+		if err != nil {
+			logger.Error("Could not migrate the database", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Database is up to date", "version", migrations.Latest())
+	case "version":
+		fmt.Println(migrations.Latest())
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,353 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is where everything a chorus server talks to lives, and how it
+// behaves.  Load builds it from, in order,
+//
+//	the defaults below
+//	a YAML file named by -config or CHORUS_CONFIG
+//	CHORUS_* environment variables
+//	command line flags
+//
+// so the same binaries can run against several clusters, or in CI, without
+// editing source.
+type Config struct {
+	Database Database `yaml:"database"`
+	PubSub   PubSub   `yaml:"pubsub"`
+	Redis    Redis    `yaml:"redis"`
+	EndUser  EndUser  `yaml:"endUser"`
+	Auth     Auth     `yaml:"auth"`
+	Leader   Leader   `yaml:"leader"`
+	Liveness Liveness `yaml:"liveness"`
+	Metrics  Metrics  `yaml:"metrics"`
+	Rooms    Rooms    `yaml:"rooms"`
+}
+
+type Database struct {
+	// URL is a libpq style connection string or postgres:// URL
+	URL string `yaml:"url"`
+	// Migrate has servers bring the schema up to date when they start,
+	// without it they only check it is the version they expect
+	Migrate bool `yaml:"migrate"`
+}
+
+type PubSub struct {
+	// Backend is kafka, nats or nats-embedded
+	Backend string   `yaml:"backend"`
+	Brokers []string `yaml:"brokers"`
+	// NATSURL is the server the nats backend connects to
+	NATSURL string `yaml:"natsURL"`
+	// NATSPort and NATSStoreDir are for the server nats-embedded starts
+	NATSPort     int    `yaml:"natsPort"`
+	NATSStoreDir string `yaml:"natsStoreDir"`
+}
+
+type Redis struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+type EndUser struct {
+	TCPAddr       string `yaml:"tcpAddr"`
+	WebSocketAddr string `yaml:"webSocketAddr"`
+}
+
+// Auth is how an EndUserServer checks the credentials in a client's hello.
+// Mode is dev, which lets everyone in, or hmac for HS256 JWTs signed with
+// Secret.
+type Auth struct {
+	Mode   string `yaml:"mode"`
+	Secret string `yaml:"secret"`
+}
+
+// Metrics is where each server serves Prometheus metrics at /metrics, empty
+// turns it off
+type Metrics struct {
+	RoomServerAddr string `yaml:"roomServerAddr"`
+	EndUserAddr    string `yaml:"endUserAddr"`
+}
+
+// Rooms is how RoomServers treat room scripts.  A handler that runs past
+// ScriptDeadline is terminated, and a room whose script is terminated
+// MaxScriptFaults times is destroyed.
+type Rooms struct {
+	ScriptDeadline  time.Duration `yaml:"scriptDeadline"`
+	MaxScriptFaults int           `yaml:"maxScriptFaults"`
+}
+
+type Leader struct {
+	// Backend is how leaders are elected, table or advisory.  ByType
+	// overrides it for a machine type, every machine of a type must agree.
+	Backend string            `yaml:"backend"`
+	ByType  map[string]string `yaml:"byType"`
+}
+
+// BackendFor is the leader backend for machineType
+func (l Leader) BackendFor(machineType string) string {
+	if backend, ok := l.ByType[machineType]; ok {
+		return backend
+	}
+	return l.Backend
+}
+
+func Default() Config {
+	return Config{
+		Database: Database{URL: "host=localhost user=postgres password=postgres sslmode=disable", Migrate: true},
+		PubSub: PubSub{
+			Backend:      "kafka",
+			Brokers:      []string{"localhost:19092"},
+			NATSURL:      "nats://localhost:4222",
+			NATSPort:     4222,
+			NATSStoreDir: filepath.Join(os.TempDir(), "chorus-nats"),
+		},
+		Redis:    Redis{Addr: "localhost:6379"},
+		EndUser:  EndUser{TCPAddr: ":8181", WebSocketAddr: ":8182"},
+		Auth:     Auth{Mode: "dev"},
+		Leader:   Leader{Backend: "table", ByType: map[string]string{}},
+		Liveness: DefaultLiveness(),
+		Metrics:  Metrics{RoomServerAddr: ":9180", EndUserAddr: ":9181"},
+		Rooms:    Rooms{ScriptDeadline: time.Duration(250) * time.Millisecond, MaxScriptFaults: 3},
+	}
+}
+
+// Load builds the config from the file, environment and args, the command
+// line without the program name.  The result is validated.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CHORUS_CONFIG"), "YAML config file")
+	databaseURL := fs.String("database-url", "", "Postgres connection string")
+	migrate := fs.Bool("migrate", true, "apply schema migrations at startup")
+	pubsub := fs.String("pubsub", "", "message bus: kafka, nats or nats-embedded")
+	brokers := fs.String("brokers", "", "comma separated Kafka brokers")
+	natsURL := fs.String("nats-url", "", "NATS server for the nats message bus")
+	redisAddr := fs.String("redis-addr", "", "Redis address")
+	tcpAddr := fs.String("tcp-addr", "", "where an EndUserServer listens for TCP clients")
+	wsAddr := fs.String("ws-addr", "", "where an EndUserServer listens for WebSocket clients")
+	auth := fs.String("auth", "", "how EndUserServers authenticate clients: dev or hmac")
+	leader := fs.String("leader", "", "leader election backend: table or advisory")
+	metricsAddr := fs.String("metrics-addr", "", "where this server serves /metrics, empty for nowhere")
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return cfg, fmt.Errorf("read config: %w", err)
+		}
+		err = yaml.Unmarshal(data, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("parse config %s: %w", *path, err)
+		}
+	}
+
+	err = cfg.applyEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	// Flags only count when they were given
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "database-url":
+			cfg.Database.URL = *databaseURL
+		case "migrate":
+			cfg.Database.Migrate = *migrate
+		case "pubsub":
+			cfg.PubSub.Backend = *pubsub
+		case "brokers":
+			cfg.PubSub.Brokers = splitList(*brokers)
+		case "nats-url":
+			cfg.PubSub.NATSURL = *natsURL
+		case "redis-addr":
+			cfg.Redis.Addr = *redisAddr
+		case "tcp-addr":
+			cfg.EndUser.TCPAddr = *tcpAddr
+		case "ws-addr":
+			cfg.EndUser.WebSocketAddr = *wsAddr
+		case "auth":
+			cfg.Auth.Mode = *auth
+		case "leader":
+			cfg.Leader.Backend = *leader
+		case "metrics-addr":
+			// Only the server being started reads its own
+			cfg.Metrics.RoomServerAddr = *metricsAddr
+			cfg.Metrics.EndUserAddr = *metricsAddr
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// applyEnv applies
+//
+//	CHORUS_DATABASE_URL, CHORUS_DATABASE_MIGRATE
+//	CHORUS_PUBSUB, CHORUS_KAFKA_BROKERS (comma separated), CHORUS_NATS_URL,
+//	CHORUS_NATS_PORT, CHORUS_NATS_STORE_DIR
+//	CHORUS_REDIS_ADDR, CHORUS_REDIS_PASSWORD
+//	CHORUS_TCP_ADDR, CHORUS_WS_ADDR
+//	CHORUS_AUTH, CHORUS_AUTH_SECRET
+//	CHORUS_LEADER, CHORUS_LEADER_<TYPE> for one machine type
+//	CHORUS_METRICS_ROOMSERVER_ADDR, CHORUS_METRICS_EUS_ADDR
+//	CHORUS_SCRIPT_DEADLINE, CHORUS_MAX_SCRIPT_FAULTS
+//	the liveness settings, see livenessEnv
+func (c *Config) applyEnv() error {
+	strs := map[string]*string{
+		"CHORUS_DATABASE_URL":   &c.Database.URL,
+		"CHORUS_PUBSUB":         &c.PubSub.Backend,
+		"CHORUS_NATS_URL":       &c.PubSub.NATSURL,
+		"CHORUS_NATS_STORE_DIR": &c.PubSub.NATSStoreDir,
+		"CHORUS_REDIS_ADDR":     &c.Redis.Addr,
+		"CHORUS_REDIS_PASSWORD": &c.Redis.Password,
+		"CHORUS_TCP_ADDR":       &c.EndUser.TCPAddr,
+		"CHORUS_WS_ADDR":        &c.EndUser.WebSocketAddr,
+		"CHORUS_AUTH":           &c.Auth.Mode,
+		"CHORUS_AUTH_SECRET":    &c.Auth.Secret,
+		"CHORUS_LEADER":         &c.Leader.Backend,
+
+		"CHORUS_METRICS_ROOMSERVER_ADDR": &c.Metrics.RoomServerAddr,
+		"CHORUS_METRICS_EUS_ADDR":        &c.Metrics.EndUserAddr,
+	}
+	for env, field := range strs {
+		if value := os.Getenv(env); value != "" {
+			*field = value
+		}
+	}
+
+	if value := os.Getenv("CHORUS_DATABASE_MIGRATE"); value != "" {
+		migrate, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("CHORUS_DATABASE_MIGRATE: %w", err)
+		}
+		c.Database.Migrate = migrate
+	}
+	if value := os.Getenv("CHORUS_KAFKA_BROKERS"); value != "" {
+		c.PubSub.Brokers = splitList(value)
+	}
+	if value := os.Getenv("CHORUS_NATS_PORT"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("CHORUS_NATS_PORT: %w", err)
+		}
+		c.PubSub.NATSPort = port
+	}
+	if value := os.Getenv("CHORUS_SCRIPT_DEADLINE"); value != "" {
+		err := parseDuration(&c.Rooms.ScriptDeadline, "CHORUS_SCRIPT_DEADLINE", value)
+		if err != nil {
+			return err
+		}
+	}
+	if value := os.Getenv("CHORUS_MAX_SCRIPT_FAULTS"); value != "" {
+		faults, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("CHORUS_MAX_SCRIPT_FAULTS: %w", err)
+		}
+		c.Rooms.MaxScriptFaults = faults
+	}
+
+	if c.Leader.ByType == nil {
+		c.Leader.ByType = map[string]string{}
+	}
+	for _, machineType := range machineTypes {
+		if value := os.Getenv("CHORUS_LEADER_" + strings.ToUpper(machineType)); value != "" {
+			c.Leader.ByType[machineType] = value
+		}
+	}
+
+	for env, key := range livenessEnv {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		field, _ := c.Liveness.field(key)
+		err := parseDuration(field, env, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// machineTypes are the servers that run leader election
+var machineTypes = []string{"RoomServer", "EUS"}
+
+func splitList(s string) []string {
+	ret := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+func (c Config) Validate() error {
+	if c.Database.URL == "" {
+		return fmt.Errorf("database url must be set")
+	}
+
+	switch c.PubSub.Backend {
+	case "kafka":
+		if len(c.PubSub.Brokers) == 0 {
+			return fmt.Errorf("kafka needs at least one broker")
+		}
+	case "nats":
+		if c.PubSub.NATSURL == "" {
+			return fmt.Errorf("nats needs a server url")
+		}
+	case "nats-embedded":
+		if c.PubSub.NATSPort <= 0 || c.PubSub.NATSPort > 65535 {
+			return fmt.Errorf("nats port %d is not a port", c.PubSub.NATSPort)
+		}
+	default:
+		return fmt.Errorf("unknown pubsub %q", c.PubSub.Backend)
+	}
+
+	switch c.Auth.Mode {
+	case "dev":
+	case "hmac":
+		if c.Auth.Secret == "" {
+			return fmt.Errorf("hmac auth needs a secret")
+		}
+	default:
+		return fmt.Errorf("unknown auth mode %q", c.Auth.Mode)
+	}
+
+	backends := map[string]string{"": c.Leader.Backend}
+	for machineType, backend := range c.Leader.ByType {
+		backends[machineType] = backend
+	}
+	for machineType, backend := range backends {
+		if backend != "table" && backend != "advisory" {
+			if machineType == "" {
+				return fmt.Errorf("unknown leader backend %q", backend)
+			}
+			return fmt.Errorf("unknown leader backend %q for %s", backend, machineType)
+		}
+	}
+
+	if c.Rooms.ScriptDeadline <= 0 {
+		return fmt.Errorf("script deadline must be positive, not %v", c.Rooms.ScriptDeadline)
+	}
+	if c.Rooms.MaxScriptFaults < 1 {
+		return fmt.Errorf("max script faults must be at least 1, not %d", c.Rooms.MaxScriptFaults)
+	}
+
+	return c.Liveness.Validate()
+}
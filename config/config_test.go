@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every CHORUS_ variable for the test, so the machine
+// running it can't change the result
+func clearEnv(t *testing.T) {
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "CHORUS_") {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chorus.yaml")
+	err := os.WriteFile(path, []byte(yaml), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testYAML = `
+database:
+  url: file-url
+pubsub:
+  brokers: [file-broker]
+endUser:
+  tcpAddr: ":1000"
+  webSocketAddr: ":1001"
+leader:
+  backend: advisory
+liveness:
+  machineExpiry: 20s
+`
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.EndUser.TCPAddr != Default().EndUser.TCPAddr || cfg.Auth.Mode != "dev" {
+					t.Errorf("cfg = %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "the file overrides defaults and leaves the rest",
+			args: []string{"-config", "FILE"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.URL != "file-url" || cfg.Leader.Backend != "advisory" || cfg.Liveness.MachineExpiry != 20*time.Second {
+					t.Errorf("cfg = %+v", cfg)
+				}
+				if cfg.Liveness.Heartbeat != DefaultLiveness().Heartbeat || cfg.Redis.Addr != Default().Redis.Addr {
+					t.Errorf("defaults lost: %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "CHORUS_CONFIG names the file",
+			env:  map[string]string{"CHORUS_CONFIG": "FILE"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.URL != "file-url" {
+					t.Errorf("url = %q", cfg.Database.URL)
+				}
+			},
+		},
+		{
+			name: "the environment overrides the file",
+			env: map[string]string{
+				"CHORUS_DATABASE_URL":   "env-url",
+				"CHORUS_KAFKA_BROKERS":  "a:1, b:2",
+				"CHORUS_MACHINE_EXPIRY": "30s",
+				"CHORUS_LEADER_EUS":     "table",
+			},
+			args: []string{"-config", "FILE"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.URL != "env-url" || cfg.Liveness.MachineExpiry != 30*time.Second {
+					t.Errorf("cfg = %+v", cfg)
+				}
+				if !slices.Equal(cfg.PubSub.Brokers, []string{"a:1", "b:2"}) {
+					t.Errorf("brokers = %v", cfg.PubSub.Brokers)
+				}
+				if cfg.Leader.BackendFor("EUS") != "table" || cfg.Leader.BackendFor("RoomServer") != "advisory" {
+					t.Errorf("leader = %+v", cfg.Leader)
+				}
+			},
+		},
+		{
+			name: "flags override the environment",
+			env:  map[string]string{"CHORUS_DATABASE_URL": "env-url", "CHORUS_TCP_ADDR": ":2000", "CHORUS_AUTH": "hmac", "CHORUS_AUTH_SECRET": "s"},
+			args: []string{"-config", "FILE", "-database-url", "flag-url", "-migrate=false", "-auth", "dev"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.URL != "flag-url" || cfg.Database.Migrate || cfg.Auth.Mode != "dev" {
+					t.Errorf("cfg = %+v", cfg)
+				}
+				// Only flags that were given count
+				if cfg.EndUser.TCPAddr != ":2000" || cfg.EndUser.WebSocketAddr != ":1001" {
+					t.Errorf("endUser = %+v", cfg.EndUser)
+				}
+			},
+		},
+		{
+			name: "hmac auth with its secret",
+			env:  map[string]string{"CHORUS_AUTH": "hmac", "CHORUS_AUTH_SECRET": "s"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Auth.Mode != "hmac" || cfg.Auth.Secret != "s" {
+					t.Errorf("auth = %+v", cfg.Auth)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			path := writeConfig(t, testYAML)
+			for name, value := range tt.env {
+				t.Setenv(name, strings.ReplaceAll(value, "FILE", path))
+			}
+			args := slices.Clone(tt.args)
+			for i := range args {
+				args[i] = strings.ReplaceAll(args[i], "FILE", path)
+			}
+
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		yaml string
+	}{
+		{name: "hmac auth without a secret", env: map[string]string{"CHORUS_AUTH": "hmac"}},
+		{name: "unknown auth", env: map[string]string{"CHORUS_AUTH": "ldap"}},
+		{name: "unknown pubsub", env: map[string]string{"CHORUS_PUBSUB": "carrier-pigeon"}},
+		{name: "unknown leader backend", env: map[string]string{"CHORUS_LEADER_EUS": "raft"}},
+		{name: "bad duration", env: map[string]string{"CHORUS_HEARTBEAT": "soon"}},
+		{name: "short expiry", env: map[string]string{"CHORUS_MACHINE_EXPIRY": "1s"}},
+		{name: "no script deadline", env: map[string]string{"CHORUS_SCRIPT_DEADLINE": "0s"}},
+		{name: "bad yaml", yaml: "database: [url"},
+		{name: "empty database url", yaml: "database:\n  url: \"\""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := []string{}
+			if tt.yaml != "" {
+				args = append(args, "-config", writeConfig(t, tt.yaml))
+			}
+
+			_, err := Load(args)
+			if err == nil {
+				t.Error("Load succeeded")
+			}
+		})
+	}
+}
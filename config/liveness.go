@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Liveness is how often machines, connections and rooms show they are
+// still there, and how long they can go quiet before they are given up on.
+// The leader, EndUserServer and RoomService all work from the same one so
+// the heartbeats and expiries can't drift apart.
+type Liveness struct {
+	// A machine touches its record every Heartbeat and is taken to be gone
+	// after MachineExpiry
+	Heartbeat     time.Duration `yaml:"heartbeat"`
+	MachineExpiry time.Duration `yaml:"machineExpiry"`
+	// An EndUserServer touches each connection every ConnectionHeartbeat,
+	// one that isn't touched for ConnectionExpiry is detached
+	ConnectionHeartbeat time.Duration `yaml:"connectionHeartbeat"`
+	ConnectionExpiry    time.Duration `yaml:"connectionExpiry"`
+	// A detached connection is deleted once its client has had
+	// ResumeGracePeriod to resume it
+	ResumeGracePeriod time.Duration `yaml:"resumeGracePeriod"`
+	// A RoomServer renews its room leases every RoomLeaseRenew, each
+	// renewal runs for RoomLease
+	RoomLeaseRenew time.Duration `yaml:"roomLeaseRenew"`
+	RoomLease      time.Duration `yaml:"roomLease"`
+	// The leader checks it is still the leader, and does its cleanup,
+	// every LeaderTick
+	LeaderTick time.Duration `yaml:"leaderTick"`
+}
+
+// minHeartbeats is how many heartbeats must fit in an expiry, so one slow or
+// missed heartbeat doesn't get something given up on
+const minHeartbeats = 3
+
+func DefaultLiveness() Liveness {
+	return Liveness{
+		Heartbeat:           time.Duration(1) * time.Second,
+		MachineExpiry:       time.Duration(5) * time.Second,
+		ConnectionHeartbeat: time.Duration(3) * time.Second,
+		ConnectionExpiry:    time.Duration(10) * time.Second,
+		ResumeGracePeriod:   time.Duration(30) * time.Second,
+		RoomLeaseRenew:      time.Duration(5) * time.Second,
+		RoomLease:           time.Duration(15) * time.Second,
+		LeaderTick:          time.Duration(1) * time.Second,
+	}
+}
+
+// livenessEnv are the environment variables for the liveness settings, they
+// take durations like "500ms" or "5s"
+var livenessEnv = map[string]string{
+	"CHORUS_HEARTBEAT":            "heartbeat",
+	"CHORUS_MACHINE_EXPIRY":       "machineExpiry",
+	"CHORUS_CONNECTION_HEARTBEAT": "connectionHeartbeat",
+	"CHORUS_CONNECTION_EXPIRY":    "connectionExpiry",
+	"CHORUS_RESUME_GRACE_PERIOD":  "resumeGracePeriod",
+	"CHORUS_ROOM_LEASE_RENEW":     "roomLeaseRenew",
+	"CHORUS_ROOM_LEASE":           "roomLease",
+	"CHORUS_LEADER_TICK":          "leaderTick",
+}
+
+func (l *Liveness) field(key string) (*time.Duration, bool) {
+	fields := map[string]*time.Duration{
+		"heartbeat":           &l.Heartbeat,
+		"machineExpiry":       &l.MachineExpiry,
+		"connectionHeartbeat": &l.ConnectionHeartbeat,
+		"connectionExpiry":    &l.ConnectionExpiry,
+		"resumeGracePeriod":   &l.ResumeGracePeriod,
+		"roomLeaseRenew":      &l.RoomLeaseRenew,
+		"roomLease":           &l.RoomLease,
+		"leaderTick":          &l.LeaderTick,
+	}
+	field, ok := fields[key]
+	return field, ok
+}
+
+func parseDuration(field *time.Duration, name string, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*field = d
+	return nil
+}
+
+// Validate checks every expiry leaves room for minHeartbeats heartbeats,
+// that detached connections get some time to be resumed and that the
+// leader ticks at all
+func (l Liveness) Validate() error {
+	if l.ResumeGracePeriod <= 0 {
+		return fmt.Errorf("resume grace period must be positive, not %v", l.ResumeGracePeriod)
+	}
+	if l.LeaderTick <= 0 {
+		return fmt.Errorf("leader tick must be positive, not %v", l.LeaderTick)
+	}
+	pairs := []struct {
+		name      string
+		heartbeat time.Duration
+		expiry    time.Duration
+	}{
+		{"machine", l.Heartbeat, l.MachineExpiry},
+		{"connection", l.ConnectionHeartbeat, l.ConnectionExpiry},
+		{"room lease", l.RoomLeaseRenew, l.RoomLease},
+	}
+	for _, p := range pairs {
+		if p.heartbeat <= 0 {
+			return fmt.Errorf("%s heartbeat must be positive, not %v", p.name, p.heartbeat)
+		}
+		if p.expiry < minHeartbeats*p.heartbeat {
+			return fmt.Errorf("%s expiry %v must be at least %d heartbeats of %v", p.name, p.expiry, minHeartbeats, p.heartbeat)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLivenessValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(l *Liveness)
+		wantErr bool
+	}{
+		{name: "defaults", change: func(l *Liveness) {}},
+		{name: "exactly three heartbeats", change: func(l *Liveness) { l.MachineExpiry = 3 * l.Heartbeat }},
+		{name: "machine expiry too short", change: func(l *Liveness) { l.MachineExpiry = 2 * l.Heartbeat }, wantErr: true},
+		{name: "connection expiry too short", change: func(l *Liveness) { l.ConnectionExpiry = l.ConnectionHeartbeat }, wantErr: true},
+		{name: "room lease too short", change: func(l *Liveness) { l.RoomLease = l.RoomLeaseRenew }, wantErr: true},
+		{name: "no heartbeat", change: func(l *Liveness) { l.Heartbeat = 0 }, wantErr: true},
+		{name: "negative lease renewal", change: func(l *Liveness) { l.RoomLeaseRenew = -time.Second }, wantErr: true},
+		{name: "no resume grace period", change: func(l *Liveness) { l.ResumeGracePeriod = 0 }, wantErr: true},
+		{name: "no leader tick", change: func(l *Liveness) { l.LeaderTick = 0 }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := DefaultLiveness()
+			tt.change(&l)
+			err := l.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -7,20 +7,24 @@ package db
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 const createConnection = `-- name: CreateConnection :exec
 
 INSERT INTO connections (
-    uuid, machine_uuid
+    uuid, machine_uuid, resume_token, user_id
 ) VALUES (
-    $1, $2
+    $1, $2, $3, $4
 )
 `
 
 type CreateConnectionParams struct {
 	Uuid        string
-	MachineUuid string
+	MachineUuid pgtype.Text
+	ResumeToken pgtype.Text
+	UserID      pgtype.Text
 }
 
 // CREATE TABLE connections (
@@ -32,7 +36,12 @@ type CreateConnectionParams struct {
 //
 // );
 func (q *Queries) CreateConnection(ctx context.Context, arg CreateConnectionParams) error {
-	_, err := q.db.Exec(ctx, createConnection, arg.Uuid, arg.MachineUuid)
+	_, err := q.db.Exec(ctx, createConnection,
+		arg.Uuid,
+		arg.MachineUuid,
+		arg.ResumeToken,
+		arg.UserID,
+	)
 	return err
 }
 
@@ -46,8 +55,35 @@ func (q *Queries) DeleteConnection(ctx context.Context, uuid string) error {
 	return err
 }
 
+const detachConnection = `-- name: DetachConnection :exec
+UPDATE connections
+SET detached_at = now()
+WHERE uuid = $1 AND machine_uuid = $2
+`
+
+type DetachConnectionParams struct {
+	Uuid        string
+	MachineUuid pgtype.Text
+}
+
+func (q *Queries) DetachConnection(ctx context.Context, arg DetachConnectionParams) error {
+	_, err := q.db.Exec(ctx, detachConnection, arg.Uuid, arg.MachineUuid)
+	return err
+}
+
+const detachConnectionsByMachine = `-- name: DetachConnectionsByMachine :exec
+UPDATE connections
+SET detached_at = now()
+WHERE machine_uuid = $1 AND detached_at IS NULL
+`
+
+func (q *Queries) DetachConnectionsByMachine(ctx context.Context, machineUuid pgtype.Text) error {
+	_, err := q.db.Exec(ctx, detachConnectionsByMachine, machineUuid)
+	return err
+}
+
 const findMachine = `-- name: FindMachine :one
-SELECT uuid, machine_uuid, created_at, last_updated FROM connections
+SELECT uuid, machine_uuid, created_at, last_updated, resume_token, detached_at, user_id FROM connections
 WHERE uuid = $1
 `
 
@@ -59,12 +95,15 @@ func (q *Queries) FindMachine(ctx context.Context, uuid string) (Connection, err
 		&i.MachineUuid,
 		&i.CreatedAt,
 		&i.LastUpdated,
+		&i.ResumeToken,
+		&i.DetachedAt,
+		&i.UserID,
 	)
 	return i, err
 }
 
 const getConnections = `-- name: GetConnections :many
-SELECT uuid, machine_uuid, created_at, last_updated FROM connections
+SELECT uuid, machine_uuid, created_at, last_updated, resume_token, detached_at, user_id FROM connections
 `
 
 func (q *Queries) GetConnections(ctx context.Context) ([]Connection, error) {
@@ -81,6 +120,9 @@ func (q *Queries) GetConnections(ctx context.Context) ([]Connection, error) {
 			&i.MachineUuid,
 			&i.CreatedAt,
 			&i.LastUpdated,
+			&i.ResumeToken,
+			&i.DetachedAt,
+			&i.UserID,
 		); err != nil {
 			return nil, err
 		}
@@ -93,11 +135,11 @@ func (q *Queries) GetConnections(ctx context.Context) ([]Connection, error) {
 }
 
 const getConnectionsByMachine = `-- name: GetConnectionsByMachine :many
-SELECT uuid, machine_uuid, created_at, last_updated FROM connections
+SELECT uuid, machine_uuid, created_at, last_updated, resume_token, detached_at, user_id FROM connections
 WHERE machine_uuid = $1
 `
 
-func (q *Queries) GetConnectionsByMachine(ctx context.Context, machineUuid string) ([]Connection, error) {
+func (q *Queries) GetConnectionsByMachine(ctx context.Context, machineUuid pgtype.Text) ([]Connection, error) {
 	rows, err := q.db.Query(ctx, getConnectionsByMachine, machineUuid)
 	if err != nil {
 		return nil, err
@@ -111,6 +153,9 @@ func (q *Queries) GetConnectionsByMachine(ctx context.Context, machineUuid strin
 			&i.MachineUuid,
 			&i.CreatedAt,
 			&i.LastUpdated,
+			&i.ResumeToken,
+			&i.DetachedAt,
+			&i.UserID,
 		); err != nil {
 			return nil, err
 		}
@@ -122,13 +167,73 @@ func (q *Queries) GetConnectionsByMachine(ctx context.Context, machineUuid strin
 	return items, nil
 }
 
+const resumeConnection = `-- name: ResumeConnection :one
+WITH previous AS (
+    SELECT uuid, machine_uuid, detached_at FROM connections
+    WHERE resume_token = $1 AND user_id = $4
+    FOR UPDATE
+)
+UPDATE connections
+SET machine_uuid = $2, resume_token = $3, detached_at = NULL, last_updated = now()
+FROM previous
+WHERE connections.uuid = previous.uuid
+RETURNING connections.uuid, connections.machine_uuid, connections.created_at, connections.last_updated, connections.resume_token, connections.detached_at, connections.user_id,
+    previous.machine_uuid AS previous_machine_uuid, previous.detached_at AS previous_detached_at
+`
+
+type ResumeConnectionParams struct {
+	ResumeToken   pgtype.Text
+	MachineUuid   pgtype.Text
+	ResumeToken_2 pgtype.Text
+	UserID        pgtype.Text
+}
+
+type ResumeConnectionRow struct {
+	Uuid                string
+	MachineUuid         pgtype.Text
+	CreatedAt           pgtype.Timestamptz
+	LastUpdated         pgtype.Timestamptz
+	ResumeToken         pgtype.Text
+	DetachedAt          pgtype.Timestamptz
+	UserID              pgtype.Text
+	PreviousMachineUuid pgtype.Text
+	PreviousDetachedAt  pgtype.Timestamptz
+}
+
+func (q *Queries) ResumeConnection(ctx context.Context, arg ResumeConnectionParams) (ResumeConnectionRow, error) {
+	row := q.db.QueryRow(ctx, resumeConnection,
+		arg.ResumeToken,
+		arg.MachineUuid,
+		arg.ResumeToken_2,
+		arg.UserID,
+	)
+	var i ResumeConnectionRow
+	err := row.Scan(
+		&i.Uuid,
+		&i.MachineUuid,
+		&i.CreatedAt,
+		&i.LastUpdated,
+		&i.ResumeToken,
+		&i.DetachedAt,
+		&i.UserID,
+		&i.PreviousMachineUuid,
+		&i.PreviousDetachedAt,
+	)
+	return i, err
+}
+
 const touchConnection = `-- name: TouchConnection :exec
 UPDATE connections 
-SET last_updated = now()
-WHERE uuid = $1
+SET last_updated = now(), detached_at = NULL
+WHERE uuid = $1 AND machine_uuid = $2
 `
 
-func (q *Queries) TouchConnection(ctx context.Context, uuid string) error {
-	_, err := q.db.Exec(ctx, touchConnection, uuid)
+type TouchConnectionParams struct {
+	Uuid        string
+	MachineUuid pgtype.Text
+}
+
+func (q *Queries) TouchConnection(ctx context.Context, arg TouchConnectionParams) error {
+	_, err := q.db.Exec(ctx, touchConnection, arg.Uuid, arg.MachineUuid)
 	return err
 }
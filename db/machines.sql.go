@@ -163,6 +163,17 @@ func (q *Queries) GetMachinesByType(ctx context.Context, machineType string) ([]
 	return items, nil
 }
 
+const releaseLeaderLock = `-- name: ReleaseLeaderLock :one
+SELECT pg_advisory_unlock(hashtext('chorus.leader.' || $1::text)::bigint)
+`
+
+func (q *Queries) ReleaseLeaderLock(ctx context.Context, machineType string) (bool, error) {
+	row := q.db.QueryRow(ctx, releaseLeaderLock, machineType)
+	var pg_advisory_unlock bool
+	err := row.Scan(&pg_advisory_unlock)
+	return pg_advisory_unlock, err
+}
+
 const setMachineAsLeader = `-- name: SetMachineAsLeader :exec
 INSERT INTO machine_type_leader (
     machine_uuid
@@ -187,6 +198,17 @@ func (q *Queries) TouchMachine(ctx context.Context, uuid string) error {
 	return err
 }
 
+const tryLeaderLock = `-- name: TryLeaderLock :one
+SELECT pg_try_advisory_lock(hashtext('chorus.leader.' || $1::text)::bigint)
+`
+
+func (q *Queries) TryLeaderLock(ctx context.Context, machineType string) (bool, error) {
+	row := q.db.QueryRow(ctx, tryLeaderLock, machineType)
+	var pg_try_advisory_lock bool
+	err := row.Scan(&pg_try_advisory_lock)
+	return pg_try_advisory_lock, err
+}
+
 const updateMachine = `-- name: UpdateMachine :exec
 UPDATE machines
 SET last_updated = NOW()
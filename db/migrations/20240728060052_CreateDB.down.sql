@@ -1 +1 @@
-delete database chorus;
+-- The database is left for whoever created it to drop.
@@ -1 +1,3 @@
-create database chorus;
+-- The database is created by dbx.Migrate when the one in the database url
+-- doesn't exist yet, CREATE DATABASE can't run inside a migration's
+-- transaction.
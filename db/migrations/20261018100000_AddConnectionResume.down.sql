@@ -0,0 +1,11 @@
+DELETE FROM room_membership WHERE connection_uuid IN (SELECT uuid FROM connections WHERE machine_uuid IS NULL);
+DELETE FROM connections WHERE machine_uuid IS NULL;
+
+ALTER TABLE connections DROP CONSTRAINT connections_machine_uuid_fkey;
+ALTER TABLE connections ADD CONSTRAINT connections_machine_uuid_fkey
+    FOREIGN KEY (machine_uuid) REFERENCES machines(uuid);
+ALTER TABLE connections ALTER COLUMN machine_uuid SET NOT NULL;
+
+DROP INDEX idx_connections_resume_token;
+ALTER TABLE connections DROP COLUMN detached_at;
+ALTER TABLE connections DROP COLUMN resume_token;
@@ -0,0 +1,12 @@
+-- A connection outlives its socket for a grace window so the client can
+-- resume it, possibly on another EUS, with the token it was handed.  While
+-- detached no EUS owns the connection.
+ALTER TABLE connections ADD COLUMN resume_token TEXT;
+ALTER TABLE connections ADD COLUMN detached_at TIMESTAMP WITH TIME ZONE;
+CREATE UNIQUE INDEX idx_connections_resume_token ON connections (resume_token);
+
+-- Detached connections survive the machine they were on
+ALTER TABLE connections ALTER COLUMN machine_uuid DROP NOT NULL;
+ALTER TABLE connections DROP CONSTRAINT connections_machine_uuid_fkey;
+ALTER TABLE connections ADD CONSTRAINT connections_machine_uuid_fkey
+    FOREIGN KEY (machine_uuid) REFERENCES machines(uuid) ON DELETE SET NULL;
@@ -0,0 +1,2 @@
+DROP INDEX idx_connections_user_id;
+ALTER TABLE connections DROP COLUMN user_id;
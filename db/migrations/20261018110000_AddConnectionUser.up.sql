@@ -0,0 +1,3 @@
+-- The user an Authenticator says is behind the connection
+ALTER TABLE connections ADD COLUMN user_id TEXT;
+CREATE INDEX idx_connections_user_id ON connections (user_id);
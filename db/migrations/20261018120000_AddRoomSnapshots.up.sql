@@ -0,0 +1,8 @@
+-- The latest state a room's script handed us, and the offset in the room's
+-- topic of the first message that came after it
+CREATE TABLE room_snapshots (
+    room_uuid TEXT PRIMARY KEY REFERENCES rooms(uuid),
+    state TEXT NOT NULL,
+    topic_offset BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
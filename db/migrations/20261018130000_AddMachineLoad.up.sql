@@ -0,0 +1,9 @@
+-- Each RoomServer reports how busy it is every few seconds, new rooms are
+-- placed on the least loaded one
+CREATE TABLE machine_load (
+    machine_uuid TEXT PRIMARY KEY REFERENCES machines(uuid) ON DELETE CASCADE,
+    room_count INTEGER NOT NULL,
+    member_count INTEGER NOT NULL,
+    script_millis BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
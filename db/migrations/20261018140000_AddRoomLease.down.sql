@@ -0,0 +1,2 @@
+ALTER TABLE rooms DROP COLUMN lease_expires;
+ALTER TABLE rooms DROP COLUMN epoch;
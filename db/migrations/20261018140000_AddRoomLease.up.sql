@@ -0,0 +1,5 @@
+-- Owning a room is a lease.  The owner renews it while it runs the room, and
+-- every change of owner bumps the epoch so a machine that has lost the room
+-- can be told apart from the one that has it now.
+ALTER TABLE rooms ADD COLUMN epoch BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE rooms ADD COLUMN lease_expires TIMESTAMP WITH TIME ZONE;
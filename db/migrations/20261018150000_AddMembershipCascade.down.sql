@@ -0,0 +1,14 @@
+ALTER TABLE room_snapshots
+    DROP CONSTRAINT room_snapshots_room_uuid_fkey,
+    ADD CONSTRAINT room_snapshots_room_uuid_fkey FOREIGN KEY (room_uuid) REFERENCES rooms(uuid);
+
+ALTER TABLE room_data
+    DROP CONSTRAINT room_data_room_uuid_fkey,
+    ADD CONSTRAINT room_data_room_uuid_fkey FOREIGN KEY (room_uuid) REFERENCES rooms(uuid);
+
+ALTER TABLE room_membership
+    DROP CONSTRAINT room_membership_connection_room_key,
+    DROP CONSTRAINT room_membership_connection_uuid_fkey,
+    DROP CONSTRAINT room_membership_room_uuid_fkey,
+    ADD CONSTRAINT room_membership_connection_uuid_fkey FOREIGN KEY (connection_uuid) REFERENCES connections(uuid),
+    ADD CONSTRAINT room_membership_room_uuid_fkey FOREIGN KEY (room_uuid) REFERENCES rooms(uuid);
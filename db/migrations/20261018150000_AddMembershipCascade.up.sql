@@ -0,0 +1,20 @@
+-- Members, data and snapshots go with their room, and members with their
+-- connection.  A connection is in a room at most once.
+DELETE FROM room_membership a
+USING room_membership b
+WHERE a.ctid < b.ctid AND a.connection_uuid = b.connection_uuid AND a.room_uuid = b.room_uuid;
+
+ALTER TABLE room_membership
+    DROP CONSTRAINT room_membership_connection_uuid_fkey,
+    DROP CONSTRAINT room_membership_room_uuid_fkey,
+    ADD CONSTRAINT room_membership_connection_uuid_fkey FOREIGN KEY (connection_uuid) REFERENCES connections(uuid) ON DELETE CASCADE,
+    ADD CONSTRAINT room_membership_room_uuid_fkey FOREIGN KEY (room_uuid) REFERENCES rooms(uuid) ON DELETE CASCADE,
+    ADD CONSTRAINT room_membership_connection_room_key UNIQUE (connection_uuid, room_uuid);
+
+ALTER TABLE room_data
+    DROP CONSTRAINT room_data_room_uuid_fkey,
+    ADD CONSTRAINT room_data_room_uuid_fkey FOREIGN KEY (room_uuid) REFERENCES rooms(uuid) ON DELETE CASCADE;
+
+ALTER TABLE room_snapshots
+    DROP CONSTRAINT room_snapshots_room_uuid_fkey,
+    ADD CONSTRAINT room_snapshots_room_uuid_fkey FOREIGN KEY (room_uuid) REFERENCES rooms(uuid) ON DELETE CASCADE;
@@ -0,0 +1,57 @@
+// Package migrations holds the schema, one numbered file per change, and
+// embeds it so the servers can bring a database up to date themselves.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// Up returns the up migrations oldest first
+func Up() ([]Migration, error) {
+	names, err := fs.Glob(files, "*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []Migration{}
+	for _, name := range names {
+		version, rest, ok := strings.Cut(strings.TrimSuffix(name, ".up.sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s has no version", name)
+		}
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", name, err)
+		}
+		sql, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Migration{Version: v, Name: rest, SQL: string(sql)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret, nil
+}
+
+// Latest is the version the schema is at once every migration has run
+func Latest() int64 {
+	up, err := Up()
+	if err != nil || len(up) == 0 {
+		return 0
+	}
+	return up[len(up)-1].Version
+}
@@ -10,9 +10,12 @@ import (
 
 type Connection struct {
 	Uuid        string
-	MachineUuid string
+	MachineUuid pgtype.Text
 	CreatedAt   pgtype.Timestamptz
 	LastUpdated pgtype.Timestamptz
+	ResumeToken pgtype.Text
+	DetachedAt  pgtype.Timestamptz
+	UserID      pgtype.Text
 }
 
 type Machine struct {
@@ -22,6 +25,14 @@ type Machine struct {
 	LastUpdated pgtype.Timestamp
 }
 
+type MachineLoad struct {
+	MachineUuid  string
+	RoomCount    int32
+	MemberCount  int32
+	ScriptMillis int64
+	UpdatedAt    pgtype.Timestamptz
+}
+
 type MachineTypeLeader struct {
 	MachineUuid string
 }
@@ -34,6 +45,8 @@ type Room struct {
 	DestroyOnOrphan bool
 	CreatedAt       pgtype.Timestamp
 	LastUpdated     pgtype.Timestamp
+	Epoch           int64
+	LeaseExpires    pgtype.Timestamptz
 }
 
 type RoomDatum struct {
@@ -46,3 +59,10 @@ type RoomMembership struct {
 	ConnectionUuid string
 	RoomUuid       string
 }
+
+type RoomSnapshot struct {
+	RoomUuid    string
+	State       string
+	TopicOffset int64
+	CreatedAt   pgtype.Timestamptz
+}
@@ -11,9 +11,9 @@ SELECT * FROM connections;
 
 -- name: CreateConnection :exec
 INSERT INTO connections (
-    uuid, machine_uuid
+    uuid, machine_uuid, resume_token, user_id
 ) VALUES (
-    $1, $2
+    $1, $2, $3, $4
 );
 
 -- name: DeleteConnection :exec
@@ -26,9 +26,32 @@ WHERE uuid = $1;
 
 -- name: TouchConnection :exec
 UPDATE connections 
-SET last_updated = now()
-WHERE uuid = $1;
+SET last_updated = now(), detached_at = NULL
+WHERE uuid = $1 AND machine_uuid = $2;
 
 -- name: GetConnectionsByMachine :many
 SELECT * FROM connections
-WHERE machine_uuid = $1;
\ No newline at end of file
+WHERE machine_uuid = $1;
+
+-- name: DetachConnection :exec
+UPDATE connections
+SET detached_at = now()
+WHERE uuid = $1 AND machine_uuid = $2;
+
+-- name: DetachConnectionsByMachine :exec
+UPDATE connections
+SET detached_at = now()
+WHERE machine_uuid = $1 AND detached_at IS NULL;
+
+-- name: ResumeConnection :one
+WITH previous AS (
+    SELECT uuid, machine_uuid, detached_at FROM connections
+    WHERE resume_token = $1 AND user_id = $4
+    FOR UPDATE
+)
+UPDATE connections
+SET machine_uuid = $2, resume_token = $3, detached_at = NULL, last_updated = now()
+FROM previous
+WHERE connections.uuid = previous.uuid
+RETURNING connections.uuid, connections.machine_uuid, connections.created_at, connections.last_updated, connections.resume_token, connections.detached_at, connections.user_id,
+    previous.machine_uuid AS previous_machine_uuid, previous.detached_at AS previous_detached_at;
@@ -0,0 +1,28 @@
+--CREATE TABLE machine_load (
+--    machine_uuid TEXT PRIMARY KEY REFERENCES machines(uuid) ON DELETE CASCADE,
+--    room_count INTEGER NOT NULL,
+--    member_count INTEGER NOT NULL,
+--    script_millis BIGINT NOT NULL,
+--    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+--);
+
+-- name: ReportMachineLoad :exec
+INSERT INTO machine_load (
+    machine_uuid, room_count, member_count, script_millis
+) VALUES (
+    $1, $2, $3, $4
+)
+ON CONFLICT (machine_uuid) DO UPDATE
+SET room_count = EXCLUDED.room_count,
+    member_count = EXCLUDED.member_count,
+    script_millis = EXCLUDED.script_millis,
+    updated_at = now();
+
+-- name: DeleteMachineLoad :exec
+DELETE FROM machine_load
+WHERE machine_uuid = $1;
+
+-- name: GetMachineLoadsByType :many
+SELECT machine_load.* FROM machine_load
+JOIN machines ON machines.uuid = machine_load.machine_uuid
+WHERE machines.machine_type = $1;
@@ -62,3 +62,9 @@ FROM machine_type_leader, machines
 WHERE machines.machine_type = $1                                                                                                                                                                         
 AND machine_type_leader.machine_uuid = machines.uuid;
 
+
+-- name: TryLeaderLock :one
+SELECT pg_try_advisory_lock(hashtext('chorus.leader.' || sqlc.arg(machine_type)::text)::bigint);
+
+-- name: ReleaseLeaderLock :one
+SELECT pg_advisory_unlock(hashtext('chorus.leader.' || sqlc.arg(machine_type)::text)::bigint);
@@ -0,0 +1,26 @@
+--CREATE TABLE room_data (
+--    room_uuid TEXT REFERENCES rooms(uuid),
+--    key TEXT NOT NULL,
+--    value TEXT
+--);
+
+-- name: GetRoomData :many
+SELECT * FROM room_data
+WHERE room_uuid = $1;
+
+-- name: SetRoomData :exec
+INSERT INTO room_data (
+    room_uuid, key, value
+) VALUES (
+    $1, $2, $3
+)
+ON CONFLICT (room_uuid, key) DO UPDATE
+SET value = EXCLUDED.value;
+
+-- name: DeleteRoomData :exec
+DELETE FROM room_data
+WHERE room_uuid = $1 AND key = $2;
+
+-- name: DeleteAllRoomData :exec
+DELETE FROM room_data
+WHERE room_uuid = $1;
@@ -0,0 +1,23 @@
+--CREATE TABLE room_snapshots (
+--    room_uuid TEXT PRIMARY KEY REFERENCES rooms(uuid),
+--    state TEXT NOT NULL,
+--    topic_offset BIGINT NOT NULL,
+--    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+--);
+
+-- name: GetRoomSnapshot :one
+SELECT * FROM room_snapshots
+WHERE room_uuid = $1;
+
+-- name: SaveRoomSnapshot :exec
+INSERT INTO room_snapshots (
+    room_uuid, state, topic_offset
+) VALUES (
+    $1, $2, $3
+)
+ON CONFLICT (room_uuid) DO UPDATE
+SET state = EXCLUDED.state, topic_offset = EXCLUDED.topic_offset, created_at = now();
+
+-- name: DeleteRoomSnapshot :exec
+DELETE FROM room_snapshots
+WHERE room_uuid = $1;
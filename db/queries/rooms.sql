@@ -12,23 +12,44 @@ SELECT * FROM rooms;
 
 -- name: CreateRoom :exec
 INSERT INTO rooms (
-    uuid, machine_uuid, name, script, destroy_on_orphan
+    uuid, machine_uuid, name, script, destroy_on_orphan, lease_expires
 ) VALUES (
-    $1, $2, $3, $4, $5
+    sqlc.arg(uuid), sqlc.arg(machine_uuid), sqlc.arg(name), sqlc.arg(script), sqlc.arg(destroy_on_orphan), now() + sqlc.arg(lease)::interval
 );
 
--- name: SetRoomOwner :exec
+-- name: SetRoomOwner :one
 UPDATE rooms 
 SET
-    machine_uuid = $2
+    machine_uuid = sqlc.arg(new_owner),
+    epoch = epoch + 1,
+    lease_expires = now() + sqlc.arg(lease)::interval
 WHERE 
-    uuid = $1
+    uuid = sqlc.arg(uuid)
 AND
-    machine_uuid = $3;
+    machine_uuid = sqlc.arg(old_owner)
+RETURNING epoch;
+
+-- name: RenewRoomLease :execrows
+UPDATE rooms
+SET lease_expires = now() + sqlc.arg(lease)::interval
+WHERE uuid = sqlc.arg(uuid) AND machine_uuid = sqlc.arg(machine_uuid) AND epoch = sqlc.arg(epoch);
+
+-- name: GetRoomEpochForShare :one
+SELECT epoch FROM rooms WHERE uuid = $1 FOR SHARE;
+
+-- name: GetExpiredRooms :many
+SELECT * FROM rooms WHERE lease_expires < now();
 
 -- name: DeleteRoom :exec
+WITH members AS (
+    DELETE FROM room_membership WHERE room_uuid = sqlc.arg(uuid)
+), data AS (
+    DELETE FROM room_data WHERE room_uuid = sqlc.arg(uuid)
+), snapshots AS (
+    DELETE FROM room_snapshots WHERE room_uuid = sqlc.arg(uuid)
+)
 DELETE FROM rooms
-WHERE uuid = $1;
+WHERE uuid = sqlc.arg(uuid);
 
 
 -- name: GetOrphanedRooms :many
@@ -36,23 +57,28 @@ SELECT * FROM rooms
 WHERE machine_uuid NOT IN (
 SELECT uuid
 FROM machines
-WHERE last_updated < NOW() - INTERVAL '5 seconds'
+WHERE last_updated >= NOW() - sqlc.arg(expiry)::interval
 );
 
+-- name: GetRoom :one
+SELECT * FROM rooms WHERE uuid = $1;
+
 -- name: GetRoomsByMachine :many
 SELECT * FROM rooms WHERE machine_uuid = $1;
 
 
 --CREATE TABLE room_membership (
 --    connection_uuid TEXT NOT NULL REFERENCES connections(uuid) ON DELETE CASCADE,
---    room_uuid TEXT NOT NULL REFERENCES rooms(uuid) ON DELETE CASCADE
+--    room_uuid TEXT NOT NULL REFERENCES rooms(uuid) ON DELETE CASCADE,
+--    UNIQUE (connection_uuid, room_uuid)
 --);
 -- name: AddRoomMember :exec
 INSERT INTO room_membership (
     connection_uuid, room_uuid
 ) VALUES (
     $1, $2
-);
+)
+ON CONFLICT (connection_uuid, room_uuid) DO NOTHING;
 
 -- name: RemoveRoomMember :exec
 DELETE FROM room_membership 
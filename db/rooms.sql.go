@@ -7,6 +7,8 @@ package db
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 const addRoomMember = `-- name: AddRoomMember :exec
@@ -15,6 +17,7 @@ INSERT INTO room_membership (
 ) VALUES (
     $1, $2
 )
+ON CONFLICT (connection_uuid, room_uuid) DO NOTHING
 `
 
 type AddRoomMemberParams struct {
@@ -35,9 +38,9 @@ func (q *Queries) AddRoomMember(ctx context.Context, arg AddRoomMemberParams) er
 
 const createRoom = `-- name: CreateRoom :exec
 INSERT INTO rooms (
-    uuid, machine_uuid, name, script, destroy_on_orphan
+    uuid, machine_uuid, name, script, destroy_on_orphan, lease_expires
 ) VALUES (
-    $1, $2, $3, $4, $5
+    $1, $2, $3, $4, $5, now() + $6::interval
 )
 `
 
@@ -47,6 +50,7 @@ type CreateRoomParams struct {
 	Name            string
 	Script          string
 	DestroyOnOrphan bool
+	Lease           pgtype.Interval
 }
 
 func (q *Queries) CreateRoom(ctx context.Context, arg CreateRoomParams) error {
@@ -56,11 +60,19 @@ func (q *Queries) CreateRoom(ctx context.Context, arg CreateRoomParams) error {
 		arg.Name,
 		arg.Script,
 		arg.DestroyOnOrphan,
+		arg.Lease,
 	)
 	return err
 }
 
 const deleteRoom = `-- name: DeleteRoom :exec
+WITH members AS (
+    DELETE FROM room_membership WHERE room_uuid = $1
+), data AS (
+    DELETE FROM room_data WHERE room_uuid = $1
+), snapshots AS (
+    DELETE FROM room_snapshots WHERE room_uuid = $1
+)
 DELETE FROM rooms
 WHERE uuid = $1
 `
@@ -70,6 +82,40 @@ func (q *Queries) DeleteRoom(ctx context.Context, uuid string) error {
 	return err
 }
 
+const getExpiredRooms = `-- name: GetExpiredRooms :many
+SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated, epoch, lease_expires FROM rooms WHERE lease_expires < now()
+`
+
+func (q *Queries) GetExpiredRooms(ctx context.Context) ([]Room, error) {
+	rows, err := q.db.Query(ctx, getExpiredRooms)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Room
+	for rows.Next() {
+		var i Room
+		if err := rows.Scan(
+			&i.Uuid,
+			&i.MachineUuid,
+			&i.Name,
+			&i.Script,
+			&i.DestroyOnOrphan,
+			&i.CreatedAt,
+			&i.LastUpdated,
+			&i.Epoch,
+			&i.LeaseExpires,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getMembershipByConnection = `-- name: GetMembershipByConnection :many
 SELECt room_uuid from room_membership where connection_uuid = $1
 `
@@ -95,16 +141,16 @@ func (q *Queries) GetMembershipByConnection(ctx context.Context, connectionUuid
 }
 
 const getOrphanedRooms = `-- name: GetOrphanedRooms :many
-SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated FROM rooms
+SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated, epoch, lease_expires FROM rooms
 WHERE machine_uuid NOT IN (
 SELECT uuid
 FROM machines
-WHERE last_updated < NOW() - INTERVAL '5 seconds'
+WHERE last_updated >= NOW() - $1::interval
 )
 `
 
-func (q *Queries) GetOrphanedRooms(ctx context.Context) ([]Room, error) {
-	rows, err := q.db.Query(ctx, getOrphanedRooms)
+func (q *Queries) GetOrphanedRooms(ctx context.Context, expiry pgtype.Interval) ([]Room, error) {
+	rows, err := q.db.Query(ctx, getOrphanedRooms, expiry)
 	if err != nil {
 		return nil, err
 	}
@@ -120,6 +166,8 @@ func (q *Queries) GetOrphanedRooms(ctx context.Context) ([]Room, error) {
 			&i.DestroyOnOrphan,
 			&i.CreatedAt,
 			&i.LastUpdated,
+			&i.Epoch,
+			&i.LeaseExpires,
 		); err != nil {
 			return nil, err
 		}
@@ -131,6 +179,38 @@ func (q *Queries) GetOrphanedRooms(ctx context.Context) ([]Room, error) {
 	return items, nil
 }
 
+const getRoom = `-- name: GetRoom :one
+SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated, epoch, lease_expires FROM rooms WHERE uuid = $1
+`
+
+func (q *Queries) GetRoom(ctx context.Context, uuid string) (Room, error) {
+	row := q.db.QueryRow(ctx, getRoom, uuid)
+	var i Room
+	err := row.Scan(
+		&i.Uuid,
+		&i.MachineUuid,
+		&i.Name,
+		&i.Script,
+		&i.DestroyOnOrphan,
+		&i.CreatedAt,
+		&i.LastUpdated,
+		&i.Epoch,
+		&i.LeaseExpires,
+	)
+	return i, err
+}
+
+const getRoomEpochForShare = `-- name: GetRoomEpochForShare :one
+SELECT epoch FROM rooms WHERE uuid = $1 FOR SHARE
+`
+
+func (q *Queries) GetRoomEpochForShare(ctx context.Context, uuid string) (int64, error) {
+	row := q.db.QueryRow(ctx, getRoomEpochForShare, uuid)
+	var epoch int64
+	err := row.Scan(&epoch)
+	return epoch, err
+}
+
 const getRoomMembers = `-- name: GetRoomMembers :many
 SELECT connection_uuid FROM room_membership where room_uuid = $1
 `
@@ -157,7 +237,7 @@ func (q *Queries) GetRoomMembers(ctx context.Context, roomUuid string) ([]string
 
 const getRooms = `-- name: GetRooms :many
 
-SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated FROM rooms
+SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated, epoch, lease_expires FROM rooms
 `
 
 // CREATE TABLE rooms (
@@ -186,6 +266,8 @@ func (q *Queries) GetRooms(ctx context.Context) ([]Room, error) {
 			&i.DestroyOnOrphan,
 			&i.CreatedAt,
 			&i.LastUpdated,
+			&i.Epoch,
+			&i.LeaseExpires,
 		); err != nil {
 			return nil, err
 		}
@@ -198,7 +280,7 @@ func (q *Queries) GetRooms(ctx context.Context) ([]Room, error) {
 }
 
 const getRoomsByMachine = `-- name: GetRoomsByMachine :many
-SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated FROM rooms WHERE machine_uuid = $1
+SELECT uuid, machine_uuid, name, script, destroy_on_orphan, created_at, last_updated, epoch, lease_expires FROM rooms WHERE machine_uuid = $1
 `
 
 func (q *Queries) GetRoomsByMachine(ctx context.Context, machineUuid string) ([]Room, error) {
@@ -218,6 +300,8 @@ func (q *Queries) GetRoomsByMachine(ctx context.Context, machineUuid string) ([]
 			&i.DestroyOnOrphan,
 			&i.CreatedAt,
 			&i.LastUpdated,
+			&i.Epoch,
+			&i.LeaseExpires,
 		); err != nil {
 			return nil, err
 		}
@@ -244,23 +328,60 @@ func (q *Queries) RemoveRoomMember(ctx context.Context, arg RemoveRoomMemberPara
 	return err
 }
 
-const setRoomOwner = `-- name: SetRoomOwner :exec
+const renewRoomLease = `-- name: RenewRoomLease :execrows
+UPDATE rooms
+SET lease_expires = now() + $1::interval
+WHERE uuid = $2 AND machine_uuid = $3 AND epoch = $4
+`
+
+type RenewRoomLeaseParams struct {
+	Lease       pgtype.Interval
+	Uuid        string
+	MachineUuid string
+	Epoch       int64
+}
+
+func (q *Queries) RenewRoomLease(ctx context.Context, arg RenewRoomLeaseParams) (int64, error) {
+	result, err := q.db.Exec(ctx, renewRoomLease,
+		arg.Lease,
+		arg.Uuid,
+		arg.MachineUuid,
+		arg.Epoch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const setRoomOwner = `-- name: SetRoomOwner :one
 UPDATE rooms 
 SET
-    machine_uuid = $2
+    machine_uuid = $1,
+    epoch = epoch + 1,
+    lease_expires = now() + $2::interval
 WHERE 
-    uuid = $1
+    uuid = $3
 AND
-    machine_uuid = $3
+    machine_uuid = $4
+RETURNING epoch
 `
 
 type SetRoomOwnerParams struct {
-	Uuid          string
-	MachineUuid   string
-	MachineUuid_2 string
+	NewOwner string
+	Lease    pgtype.Interval
+	Uuid     string
+	OldOwner string
 }
 
-func (q *Queries) SetRoomOwner(ctx context.Context, arg SetRoomOwnerParams) error {
-	_, err := q.db.Exec(ctx, setRoomOwner, arg.Uuid, arg.MachineUuid, arg.MachineUuid_2)
-	return err
+func (q *Queries) SetRoomOwner(ctx context.Context, arg SetRoomOwnerParams) (int64, error) {
+	row := q.db.QueryRow(ctx, setRoomOwner,
+		arg.NewOwner,
+		arg.Lease,
+		arg.Uuid,
+		arg.OldOwner,
+	)
+	var epoch int64
+	err := row.Scan(&epoch)
+	return epoch, err
 }
@@ -2,35 +2,104 @@ package dbx
 
 import (
 	"context"
+	"errors"
 	"sync/atomic"
+	"time"
 
+	"github.com/hoyle1974/chorus/config"
 	"github.com/hoyle1974/chorus/db"
+	"github.com/hoyle1974/chorus/misc"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var conn atomic.Pointer[pgx.Conn]
+var pool atomic.Pointer[pgxpool.Pool]
 
-func NewConn() (*pgx.Conn, error) {
-	connStr := "host=localhost user=postgres password=postgres sslmode=disable"
+// ErrNotFound is returned when the row a query is about doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// notFound turns pgx's missing row into ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+var connStr = config.Default().Database.URL
 
+// Configure sets the database NewConn and GetConn connect to, call it before
+// anything else in dbx
+func Configure(cfg config.Database) {
+	connStr = cfg.URL
+}
+
+// NewConn opens a connection of its own, for things that need one session
+// such as LISTEN or holding an advisory lock.  Everything else should use
+// GetConn.
+func NewConn() (*pgx.Conn, error) {
 	return pgx.Connect(context.Background(), connStr)
 }
 
-func GetConn() *pgx.Conn {
-	if conn.Load() != nil {
-		return conn.Load()
+// GetConn returns the pool shared by the whole process, it is safe to use
+// from any goroutine
+func GetConn() *pgxpool.Pool {
+	if pool.Load() != nil {
+		return pool.Load()
 	}
 
-	db, err := NewConn()
+	p, err := pgxpool.New(context.Background(), connStr)
 	if err != nil {
 		panic(err)
 	}
 
-	old := conn.Swap(db)
-	if old != nil {
-		old.Close(context.Background())
+	if !pool.CompareAndSwap(nil, p) {
+		// Someone beat us to it
+		p.Close()
 	}
-	return db
+	return pool.Load()
+}
+
+// WithTx runs fn in a transaction, it is committed if fn returns nil and
+// rolled back otherwise
+func WithTx(ctx context.Context, fn func(q QueriesX) error) error {
+	tx, err := GetConn().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	err = fn(Dbx().Queries(db.New(tx)))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Database is where the servers keep their state: queries against it and
+// transactions on it.  Postgres is the real one, a Memory stands in for it
+// in tests.
+type Database interface {
+	Queries() QueriesX
+	// WithTx runs fn in a transaction, it is committed if fn returns nil
+	// and rolled back otherwise
+	WithTx(ctx context.Context, fn func(q QueriesX) error) error
+}
+
+type postgresDatabase struct{}
+
+// Postgres is the database Configure points at, through the shared pool
+func Postgres() Database {
+	return postgresDatabase{}
+}
+
+func (postgresDatabase) Queries() QueriesX {
+	return Dbx().Queries(db.New(GetConn()))
+}
+
+func (postgresDatabase) WithTx(ctx context.Context, fn func(q QueriesX) error) error {
+	return WithTx(ctx, fn)
 }
 
 type DBX struct {
@@ -40,10 +109,77 @@ func Dbx() DBX {
 	return DBX{}
 }
 
-type QueriesX struct {
+// QueriesX is everything the servers ask of the database.  Queries gives
+// the Postgres one, Memory is a stand in for tests.
+type QueriesX interface {
+	// Machines and leaders
+	GetMachines(ctx context.Context) ([]Machine, error)
+	GetMachinesByType(ctx context.Context, machineType string) ([]Machine, error)
+	CreateMachine(ctx context.Context, machineId misc.MachineId, machineType string) error
+	DeleteMachine(ctx context.Context, machineId misc.MachineId) error
+	GetMachine(ctx context.Context, machineId misc.MachineId) (Machine, error)
+	IsMachineOnline(ctx context.Context, machineId misc.MachineId, expiry time.Duration) (bool, error)
+	TouchMachine(ctx context.Context, machineId misc.MachineId) error
+	GetLeaderForType(ctx context.Context, machineType string) misc.MachineId
+	SetMachineAsLeader(ctx context.Context, uuid misc.MachineId) error
+	DeleteLeader(ctx context.Context, uuid misc.MachineId) error
+	TryLeaderLock(ctx context.Context, machineType string) (bool, error)
+	ReleaseLeaderLock(ctx context.Context, machineType string) (bool, error)
+
+	// Machine load
+	ReportMachineLoad(ctx context.Context, load MachineLoad) error
+	DeleteMachineLoad(ctx context.Context, machineId misc.MachineId) error
+	GetMachineLoadsByType(ctx context.Context, machineType string) ([]MachineLoad, error)
+
+	// Connections
+	GetConnections(ctx context.Context) ([]Connection, error)
+	FindMachine(ctx context.Context, id misc.ConnectionId) misc.MachineId
+	CreateConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId, userId string, resumeToken string) error
+	DeleteConnection(ctx context.Context, connectionId misc.ConnectionId) error
+	TouchConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error
+	GetConnectionsByMachine(ctx context.Context, machineId misc.MachineId) ([]Connection, error)
+	DetachConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error
+	DetachConnectionsByMachine(ctx context.Context, machineId misc.MachineId) error
+	ResumeConnection(ctx context.Context, resumeToken string, userId string, machineId misc.MachineId, newResumeToken string) (Connection, misc.MachineId, error)
+
+	// Rooms and their members
+	GetRooms(ctx context.Context) ([]Room, error)
+	GetOrphanedRooms(ctx context.Context, expiry time.Duration) ([]Room, error)
+	GetRoom(ctx context.Context, roomId misc.RoomId) (Room, error)
+	GetRoomsByMachine(ctx context.Context, machineId misc.MachineId) ([]Room, error)
+	GetExpiredRooms(ctx context.Context) ([]Room, error)
+	CreateRoom(ctx context.Context, roomId misc.RoomId, machineId misc.MachineId, name string, script string, destroyOnOrphan bool, lease time.Duration) error
+	DeleteRoom(ctx context.Context, roomId misc.RoomId) error
+	SetRoomOwner(ctx context.Context, roomId misc.RoomId, oldOwner misc.MachineId, newOwner misc.MachineId, lease time.Duration) (int64, error)
+	RenewRoomLease(ctx context.Context, roomId misc.RoomId, machineId misc.MachineId, epoch int64, lease time.Duration) (bool, error)
+	CheckRoomEpoch(ctx context.Context, roomId misc.RoomId, epoch int64) error
+	GetRoomMembers(ctx context.Context, roomId misc.RoomId) ([]misc.ConnectionId, error)
+	GetMembershipByConnection(ctx context.Context, connectionId misc.ConnectionId) ([]misc.ConnectionId, error)
+	AddRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error
+	RemoveRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error
+
+	// Room storage and snapshots
+	GetRoomData(ctx context.Context, roomId misc.RoomId) (map[string]string, error)
+	SetRoomData(ctx context.Context, roomId misc.RoomId, key string, value string) error
+	DeleteRoomData(ctx context.Context, roomId misc.RoomId, key string) error
+	DeleteAllRoomData(ctx context.Context, roomId misc.RoomId) error
+	GetRoomSnapshot(ctx context.Context, roomId misc.RoomId) (RoomSnapshot, error)
+	SaveRoomSnapshot(ctx context.Context, roomId misc.RoomId, state string, offset int64) error
+	DeleteRoomSnapshot(ctx context.Context, roomId misc.RoomId) error
+}
+
+type postgresQueries struct {
 	q *db.Queries
 }
 
 func (dbx DBX) Queries(q *db.Queries) QueriesX {
-	return QueriesX{q: q}
+	return postgresQueries{q: q}
+}
+
+func text(s string) pgtype.Text {
+	return pgtype.Text{String: s, Valid: true}
+}
+
+func interval(d time.Duration) pgtype.Interval {
+	return pgtype.Interval{Microseconds: d.Microseconds(), Valid: true}
 }
@@ -11,21 +11,34 @@ import (
 type Connection struct {
 	Uuid        misc.ConnectionId
 	MachineUuid misc.MachineId
+	UserId      string
 	CreatedAt   time.Time
 	LastUpdated time.Time
+	DetachedAt  time.Time
+}
+
+// Detached connections have lost their socket but can still be resumed
+func (c Connection) Detached() bool {
+	return !c.DetachedAt.IsZero()
 }
 
 func toConnection(in db.Connection) Connection {
+	machineId := misc.NilMachineId
+	if in.MachineUuid.Valid {
+		machineId = misc.MachineId(in.MachineUuid.String)
+	}
 	return Connection{
 		Uuid:        misc.ConnectionId(in.Uuid),
-		MachineUuid: misc.MachineId(in.MachineUuid),
+		MachineUuid: machineId,
+		UserId:      in.UserID.String,
 		CreatedAt:   in.CreatedAt.Time,
 		LastUpdated: in.LastUpdated.Time,
+		DetachedAt:  in.DetachedAt.Time,
 	}
 }
 
-func (c QueriesX) GetConnections() ([]Connection, error) {
-	rows, err := c.q.GetConnections(context.Background())
+func (c postgresQueries) GetConnections(ctx context.Context) ([]Connection, error) {
+	rows, err := c.q.GetConnections(ctx)
 	connections := []Connection{}
 	if err != nil {
 		return connections, err
@@ -36,28 +49,40 @@ func (c QueriesX) GetConnections() ([]Connection, error) {
 	return connections, err
 }
 
-func (c QueriesX) FindMachine(id misc.ConnectionId) misc.MachineId {
-	conn, err := c.q.FindMachine(context.Background(), string(id))
+func (c postgresQueries) FindMachine(ctx context.Context, id misc.ConnectionId) misc.MachineId {
+	conn, err := c.q.FindMachine(ctx, string(id))
 	if err != nil {
 		return misc.NilMachineId
 	}
 	return toConnection(conn).MachineUuid
 }
 
-func (c QueriesX) CreateConnection(connectionId misc.ConnectionId, machineId misc.MachineId) error {
-	return c.q.CreateConnection(context.Background(), db.CreateConnectionParams{Uuid: string(connectionId), MachineUuid: string(machineId)})
+func (c postgresQueries) CreateConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId, userId string, resumeToken string) error {
+	return c.q.CreateConnection(ctx, db.CreateConnectionParams{
+		Uuid:        string(connectionId),
+		MachineUuid: text(string(machineId)),
+		ResumeToken: text(resumeToken),
+		UserID:      text(userId),
+	})
 }
 
-func (c QueriesX) DeleteConnection(connectionId misc.ConnectionId) error {
-	return c.q.DeleteConnection(context.Background(), string(connectionId))
+func (c postgresQueries) DeleteConnection(ctx context.Context, connectionId misc.ConnectionId) error {
+	return c.q.DeleteConnection(ctx, string(connectionId))
 }
 
-func (c QueriesX) TouchConnection(connectionId misc.ConnectionId) error {
-	return c.q.TouchConnection(context.Background(), string(connectionId))
+// TouchConnection also reattaches the connection, a late heartbeat or a
+// machine wrongly taken for offline may have detached it while its socket
+// was still open.  Only machineId, the machine holding the connection, can
+// touch it, so a connection resumed elsewhere isn't held on to.
+func (c postgresQueries) TouchConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error {
+	return c.q.TouchConnection(ctx, db.TouchConnectionParams{
+		Uuid:        string(connectionId),
+		MachineUuid: text(string(machineId)),
+	})
 }
 
-func (c QueriesX) GetConnectionsByMachine(machineId misc.MachineId) ([]Connection, error) {
-	rows, err := c.q.GetConnectionsByMachine(context.Background(), string(machineId))
+func (c postgresQueries) GetConnectionsByMachine(ctx context.Context, machineId misc.MachineId) ([]Connection, error) {
+	rows, err := c.q.GetConnectionsByMachine(ctx, text(string(machineId)))
 	connections := []Connection{}
 	if err != nil {
 		return connections, err
@@ -67,3 +92,46 @@ func (c QueriesX) GetConnectionsByMachine(machineId misc.MachineId) ([]Connectio
 	}
 	return connections, err
 }
+
+// DetachConnection detaches the connection if it is still on machineId
+func (c postgresQueries) DetachConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error {
+	return c.q.DetachConnection(ctx, db.DetachConnectionParams{
+		Uuid:        string(connectionId),
+		MachineUuid: text(string(machineId)),
+	})
+}
+
+func (c postgresQueries) DetachConnectionsByMachine(ctx context.Context, machineId misc.MachineId) error {
+	return c.q.DetachConnectionsByMachine(ctx, text(string(machineId)))
+}
+
+// ResumeConnection moves userId's connection holding resumeToken over to
+// machineId and hands it newResumeToken for next time.  The connection may
+// still be attached somewhere, a client that lost its socket can come back
+// before the old machine notices, takenFrom is that machine or
+// misc.NilMachineId if the connection was detached.
+func (c postgresQueries) ResumeConnection(ctx context.Context, resumeToken string, userId string, machineId misc.MachineId, newResumeToken string) (Connection, misc.MachineId, error) {
+	row, err := c.q.ResumeConnection(ctx, db.ResumeConnectionParams{
+		ResumeToken:   text(resumeToken),
+		MachineUuid:   text(string(machineId)),
+		ResumeToken_2: text(newResumeToken),
+		UserID:        text(userId),
+	})
+	if err != nil {
+		return Connection{}, misc.NilMachineId, notFound(err)
+	}
+	conn := toConnection(db.Connection{
+		Uuid:        row.Uuid,
+		MachineUuid: row.MachineUuid,
+		CreatedAt:   row.CreatedAt,
+		LastUpdated: row.LastUpdated,
+		ResumeToken: row.ResumeToken,
+		DetachedAt:  row.DetachedAt,
+		UserID:      row.UserID,
+	})
+	takenFrom := misc.NilMachineId
+	if row.PreviousMachineUuid.Valid && !row.PreviousDetachedAt.Valid {
+		takenFrom = misc.MachineId(row.PreviousMachineUuid.String)
+	}
+	return conn, takenFrom, nil
+}
@@ -0,0 +1,48 @@
+package dbx
+
+import (
+	"context"
+	"time"
+
+	"github.com/hoyle1974/chorus/db"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+type MachineLoad struct {
+	MachineId    misc.MachineId
+	Rooms        int
+	Members      int
+	ScriptMillis int64 // time spent running scripts since the last report
+	UpdatedAt    time.Time
+}
+
+func (c postgresQueries) ReportMachineLoad(ctx context.Context, load MachineLoad) error {
+	return c.q.ReportMachineLoad(ctx, db.ReportMachineLoadParams{
+		MachineUuid:  string(load.MachineId),
+		RoomCount:    int32(load.Rooms),
+		MemberCount:  int32(load.Members),
+		ScriptMillis: load.ScriptMillis,
+	})
+}
+
+func (c postgresQueries) DeleteMachineLoad(ctx context.Context, machineId misc.MachineId) error {
+	return c.q.DeleteMachineLoad(ctx, string(machineId))
+}
+
+func (c postgresQueries) GetMachineLoadsByType(ctx context.Context, machineType string) ([]MachineLoad, error) {
+	rows, err := c.q.GetMachineLoadsByType(ctx, machineType)
+	loads := []MachineLoad{}
+	if err != nil {
+		return loads, err
+	}
+	for _, row := range rows {
+		loads = append(loads, MachineLoad{
+			MachineId:    misc.MachineId(row.MachineUuid),
+			Rooms:        int(row.RoomCount),
+			Members:      int(row.MemberCount),
+			ScriptMillis: row.ScriptMillis,
+			UpdatedAt:    row.UpdatedAt.Time,
+		})
+	}
+	return loads, nil
+}
@@ -8,17 +8,20 @@ import (
 	"github.com/hoyle1974/chorus/misc"
 )
 
-func timeoutCtx(seconds int) context.Context {
-	ctx, _ := context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
-	return ctx
-}
-
-func (c QueriesX) GetMachines() {
-	c.q.GetMachines(context.Background())
+func (c postgresQueries) GetMachines(ctx context.Context) ([]Machine, error) {
+	ms, err := c.q.GetMachines(ctx)
+	machines := []Machine{}
+	if err != nil {
+		return machines, err
+	}
+	for _, dbMachine := range ms {
+		machines = append(machines, toMachine(dbMachine))
+	}
+	return machines, err
 }
 
-func (c QueriesX) GetMachinesByType(machineType string) ([]Machine, error) {
-	ms, err := c.q.GetMachinesByType(context.Background(), machineType)
+func (c postgresQueries) GetMachinesByType(ctx context.Context, machineType string) ([]Machine, error) {
+	ms, err := c.q.GetMachinesByType(ctx, machineType)
 	machines := []Machine{}
 	if err != nil {
 		return machines, err
@@ -29,15 +32,15 @@ func (c QueriesX) GetMachinesByType(machineType string) ([]Machine, error) {
 	return machines, err
 }
 
-func (c QueriesX) CreateMachine(machineId misc.MachineId, machineType string) error {
-	return c.q.CreateMachine(context.Background(), db.CreateMachineParams{
+func (c postgresQueries) CreateMachine(ctx context.Context, machineId misc.MachineId, machineType string) error {
+	return c.q.CreateMachine(ctx, db.CreateMachineParams{
 		Uuid:        string(machineId),
 		MachineType: machineType,
 	})
 }
 
-func (c QueriesX) DeleteMachine(machineId misc.MachineId) error {
-	return c.q.DeleteMachine(context.Background(), string(machineId))
+func (c postgresQueries) DeleteMachine(ctx context.Context, machineId misc.MachineId) error {
+	return c.q.DeleteMachine(ctx, string(machineId))
 }
 
 type Machine struct {
@@ -56,34 +59,48 @@ func toMachine(in db.Machine) Machine {
 	}
 }
 
-func (c QueriesX) GetMachine(machineId misc.MachineId) (Machine, error) {
-	s, err := c.q.GetMachine(context.Background(), string(machineId))
-	return toMachine(s), err
+func (c postgresQueries) GetMachine(ctx context.Context, machineId misc.MachineId) (Machine, error) {
+	s, err := c.q.GetMachine(ctx, string(machineId))
+	return toMachine(s), notFound(err)
 }
 
-func (c QueriesX) IsMachineOnline(machineId misc.MachineId) (bool, error) {
-	machine, err := c.GetMachine(machineId)
+func (c postgresQueries) IsMachineOnline(ctx context.Context, machineId misc.MachineId, expiry time.Duration) (bool, error) {
+	machine, err := c.GetMachine(ctx, machineId)
 	if err != nil {
 		return false, err
 	}
-	if time.Since(machine.LastUpdated) < time.Duration(5)*time.Second {
+	if time.Since(machine.LastUpdated) < expiry {
 		return true, nil
 	}
 	return false, nil
 }
 
-func (c QueriesX) TouchMachine(machineId misc.MachineId) error {
-	return c.q.TouchMachine(timeoutCtx(5), string(machineId))
+func (c postgresQueries) TouchMachine(ctx context.Context, machineId misc.MachineId) error {
+	return c.q.TouchMachine(ctx, string(machineId))
 }
 
-func (c QueriesX) GetLeaderForType(machineType string) misc.MachineId {
-	s, err := c.q.GetLeaderForType(context.Background(), machineType)
+func (c postgresQueries) GetLeaderForType(ctx context.Context, machineType string) misc.MachineId {
+	s, err := c.q.GetLeaderForType(ctx, machineType)
 	if err != nil {
 		return misc.NilMachineId
 	}
 	return misc.MachineId(s)
 }
 
-func (c QueriesX) SetMachineAsLeader(uuid misc.MachineId) error {
-	return c.q.SetMachineAsLeader(context.Background(), string(uuid))
+func (c postgresQueries) SetMachineAsLeader(ctx context.Context, uuid misc.MachineId) error {
+	return c.q.SetMachineAsLeader(ctx, string(uuid))
+}
+
+// TryLeaderLock takes the advisory lock that makes this session the leader
+// for machineType, false if another session has it
+func (c postgresQueries) TryLeaderLock(ctx context.Context, machineType string) (bool, error) {
+	return c.q.TryLeaderLock(ctx, machineType)
+}
+
+func (c postgresQueries) ReleaseLeaderLock(ctx context.Context, machineType string) (bool, error) {
+	return c.q.ReleaseLeaderLock(ctx, machineType)
+}
+
+func (c postgresQueries) DeleteLeader(ctx context.Context, uuid misc.MachineId) error {
+	return c.q.DeleteLeader(ctx, string(uuid))
 }
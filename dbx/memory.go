@@ -0,0 +1,756 @@
+package dbx
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+/*
+ * Memory is a QueriesX that keeps the tables in maps, so server logic such
+ * as failover and cleanup can be tested without Postgres.  It follows the
+ * queries closely:
+ *
+ *	- a missing row is ErrNotFound
+ *	- a duplicate key or a missing reference is the *pgconn.PgError
+ *	  Postgres would return, with the same code and constraint name
+ *	- deleting a machine, connection or room cascades, or sets references
+ *	  to nil, the way the schema does
+ *
+ * Each call is atomic.  WithTx runs one transaction at a time and puts the
+ * tables back if it fails, but calls made outside a transaction can still
+ * see its writes before it finishes.  Rows come back ordered by their key.
+ */
+
+var (
+	_ QueriesX = (*Memory)(nil)
+	_ Database = (*Memory)(nil)
+)
+
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+type Memory struct {
+	// Now is the clock rows are timestamped with, tests can replace it to
+	// make machines, connections and leases expire
+	Now func() time.Time
+
+	lock sync.Mutex
+	tx   sync.Mutex // held by WithTx
+	memoryTables
+}
+
+type memoryTables struct {
+	machines    map[misc.MachineId]Machine
+	leaders     map[misc.MachineId]bool
+	leaderLocks map[string]bool
+	loads       map[misc.MachineId]MachineLoad
+	connections map[misc.ConnectionId]memoryConnection
+	rooms       map[misc.RoomId]Room
+	members     []membership
+	roomData    map[misc.RoomId]map[string]string
+	snapshots   map[misc.RoomId]RoomSnapshot
+}
+
+type memoryConnection struct {
+	Connection
+	resumeToken string
+}
+
+type membership struct {
+	connectionId misc.ConnectionId
+	roomId       misc.RoomId
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		Now: time.Now,
+		memoryTables: memoryTables{
+			machines:    map[misc.MachineId]Machine{},
+			leaders:     map[misc.MachineId]bool{},
+			leaderLocks: map[string]bool{},
+			loads:       map[misc.MachineId]MachineLoad{},
+			connections: map[misc.ConnectionId]memoryConnection{},
+			rooms:       map[misc.RoomId]Room{},
+			roomData:    map[misc.RoomId]map[string]string{},
+			snapshots:   map[misc.RoomId]RoomSnapshot{},
+		},
+	}
+}
+
+// Queries returns m, a Memory is its own QueriesX
+func (m *Memory) Queries() QueriesX {
+	return m
+}
+
+// WithTx runs fn against m, putting every table back the way it was if fn
+// returns an error
+func (m *Memory) WithTx(ctx context.Context, fn func(q QueriesX) error) error {
+	m.tx.Lock()
+	defer m.tx.Unlock()
+
+	m.lock.Lock()
+	saved := m.memoryTables.copy()
+	m.lock.Unlock()
+
+	err := fn(m)
+	if err != nil {
+		m.lock.Lock()
+		m.memoryTables = saved
+		m.lock.Unlock()
+	}
+	return err
+}
+
+func (t memoryTables) copy() memoryTables {
+	roomData := make(map[misc.RoomId]map[string]string, len(t.roomData))
+	for roomId, data := range t.roomData {
+		roomData[roomId] = maps.Clone(data)
+	}
+	return memoryTables{
+		machines:    maps.Clone(t.machines),
+		leaders:     maps.Clone(t.leaders),
+		leaderLocks: maps.Clone(t.leaderLocks),
+		loads:       maps.Clone(t.loads),
+		connections: maps.Clone(t.connections),
+		rooms:       maps.Clone(t.rooms),
+		members:     slices.Clone(t.members),
+		roomData:    roomData,
+		snapshots:   maps.Clone(t.snapshots),
+	}
+}
+
+func violation(code string, constraint string, format string, args ...any) error {
+	return &pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           code,
+		ConstraintName: constraint,
+		Message:        fmt.Sprintf(format, args...),
+	}
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Machines and leaders
+
+func (m *Memory) GetMachines(ctx context.Context) ([]Machine, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machines := []Machine{}
+	for _, id := range sortedKeys(m.machines) {
+		machines = append(machines, m.machines[id])
+	}
+	return machines, nil
+}
+
+func (m *Memory) GetMachinesByType(ctx context.Context, machineType string) ([]Machine, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machines := []Machine{}
+	for _, id := range sortedKeys(m.machines) {
+		if m.machines[id].MachineType == machineType {
+			machines = append(machines, m.machines[id])
+		}
+	}
+	return machines, nil
+}
+
+func (m *Memory) CreateMachine(ctx context.Context, machineId misc.MachineId, machineType string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.machines[machineId]; ok {
+		return violation(uniqueViolation, "machines_pkey", "machine %s already exists", machineId)
+	}
+	now := m.Now()
+	m.machines[machineId] = Machine{Uuid: machineId, MachineType: machineType, CreatedAt: now, LastUpdated: now}
+	return nil
+}
+
+// DeleteMachine fails while the machine still owns rooms, its leader row
+// and load report go with it and its connections are left with no machine
+func (m *Memory) DeleteMachine(ctx context.Context, machineId misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, room := range m.rooms {
+		if room.MachineUuid == machineId {
+			return violation(foreignKeyViolation, "rooms_machine_uuid_fkey", "machine %s still owns room %s", machineId, room.Uuid)
+		}
+	}
+
+	delete(m.machines, machineId)
+	delete(m.leaders, machineId)
+	delete(m.loads, machineId)
+	for id, conn := range m.connections {
+		if conn.MachineUuid == machineId {
+			conn.MachineUuid = misc.NilMachineId
+			m.connections[id] = conn
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetMachine(ctx context.Context, machineId misc.MachineId) (Machine, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machine, ok := m.machines[machineId]
+	if !ok {
+		return Machine{}, ErrNotFound
+	}
+	return machine, nil
+}
+
+func (m *Memory) IsMachineOnline(ctx context.Context, machineId misc.MachineId, expiry time.Duration) (bool, error) {
+	machine, err := m.GetMachine(ctx, machineId)
+	if err != nil {
+		return false, err
+	}
+	return m.Now().Sub(machine.LastUpdated) < expiry, nil
+}
+
+func (m *Memory) TouchMachine(ctx context.Context, machineId misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if machine, ok := m.machines[machineId]; ok {
+		machine.LastUpdated = m.Now()
+		m.machines[machineId] = machine
+	}
+	return nil
+}
+
+func (m *Memory) GetLeaderForType(ctx context.Context, machineType string) misc.MachineId {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, id := range sortedKeys(m.leaders) {
+		if m.machines[id].MachineType == machineType {
+			return id
+		}
+	}
+	return misc.NilMachineId
+}
+
+func (m *Memory) SetMachineAsLeader(ctx context.Context, uuid misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.machines[uuid]; !ok {
+		return violation(foreignKeyViolation, "machine_type_leader_machine_uuid_fkey", "machine %s does not exist", uuid)
+	}
+	if m.leaders[uuid] {
+		return violation(uniqueViolation, "machine_type_leader_pkey", "machine %s is already a leader", uuid)
+	}
+	m.leaders[uuid] = true
+	return nil
+}
+
+func (m *Memory) DeleteLeader(ctx context.Context, uuid misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.leaders, uuid)
+	return nil
+}
+
+// TryLeaderLock stands in for the advisory lock.  There are no sessions, so
+// only the first caller gets it until it is released.
+func (m *Memory) TryLeaderLock(ctx context.Context, machineType string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.leaderLocks[machineType] {
+		return false, nil
+	}
+	m.leaderLocks[machineType] = true
+	return true, nil
+}
+
+func (m *Memory) ReleaseLeaderLock(ctx context.Context, machineType string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	held := m.leaderLocks[machineType]
+	delete(m.leaderLocks, machineType)
+	return held, nil
+}
+
+// Machine load
+
+func (m *Memory) ReportMachineLoad(ctx context.Context, load MachineLoad) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.machines[load.MachineId]; !ok {
+		return violation(foreignKeyViolation, "machine_load_machine_uuid_fkey", "machine %s does not exist", load.MachineId)
+	}
+	load.UpdatedAt = m.Now()
+	m.loads[load.MachineId] = load
+	return nil
+}
+
+func (m *Memory) DeleteMachineLoad(ctx context.Context, machineId misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.loads, machineId)
+	return nil
+}
+
+func (m *Memory) GetMachineLoadsByType(ctx context.Context, machineType string) ([]MachineLoad, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	loads := []MachineLoad{}
+	for _, id := range sortedKeys(m.loads) {
+		if m.machines[id].MachineType == machineType {
+			loads = append(loads, m.loads[id])
+		}
+	}
+	return loads, nil
+}
+
+// Connections
+
+func (m *Memory) GetConnections(ctx context.Context) ([]Connection, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	connections := []Connection{}
+	for _, id := range sortedKeys(m.connections) {
+		connections = append(connections, m.connections[id].Connection)
+	}
+	return connections, nil
+}
+
+func (m *Memory) FindMachine(ctx context.Context, id misc.ConnectionId) misc.MachineId {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	conn, ok := m.connections[id]
+	if !ok {
+		return misc.NilMachineId
+	}
+	return conn.MachineUuid
+}
+
+func (m *Memory) CreateConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId, userId string, resumeToken string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.connections[connectionId]; ok {
+		return violation(uniqueViolation, "connections_pkey", "connection %s already exists", connectionId)
+	}
+	if _, ok := m.machines[machineId]; !ok {
+		return violation(foreignKeyViolation, "connections_machine_uuid_fkey", "machine %s does not exist", machineId)
+	}
+	if m.resumeTokenTaken(resumeToken, connectionId) {
+		return violation(uniqueViolation, "idx_connections_resume_token", "resume token is already in use")
+	}
+
+	now := m.Now()
+	m.connections[connectionId] = memoryConnection{
+		Connection: Connection{
+			Uuid:        connectionId,
+			MachineUuid: machineId,
+			UserId:      userId,
+			CreatedAt:   now,
+			LastUpdated: now,
+		},
+		resumeToken: resumeToken,
+	}
+	return nil
+}
+
+func (m *Memory) resumeTokenTaken(resumeToken string, except misc.ConnectionId) bool {
+	for id, conn := range m.connections {
+		if id != except && conn.resumeToken == resumeToken {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteConnection takes the connection out of every room it was in
+func (m *Memory) DeleteConnection(ctx context.Context, connectionId misc.ConnectionId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.connections, connectionId)
+	m.removeMembers(func(mem membership) bool { return mem.connectionId == connectionId })
+	return nil
+}
+
+func (m *Memory) TouchConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if conn, ok := m.connections[connectionId]; ok && conn.MachineUuid == machineId {
+		conn.LastUpdated = m.Now()
+		conn.DetachedAt = time.Time{}
+		m.connections[connectionId] = conn
+	}
+	return nil
+}
+
+func (m *Memory) GetConnectionsByMachine(ctx context.Context, machineId misc.MachineId) ([]Connection, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	connections := []Connection{}
+	for _, id := range sortedKeys(m.connections) {
+		if m.connections[id].MachineUuid == machineId {
+			connections = append(connections, m.connections[id].Connection)
+		}
+	}
+	return connections, nil
+}
+
+func (m *Memory) DetachConnection(ctx context.Context, connectionId misc.ConnectionId, machineId misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if conn, ok := m.connections[connectionId]; ok && conn.MachineUuid == machineId {
+		conn.DetachedAt = m.Now()
+		m.connections[connectionId] = conn
+	}
+	return nil
+}
+
+func (m *Memory) DetachConnectionsByMachine(ctx context.Context, machineId misc.MachineId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for id, conn := range m.connections {
+		if conn.MachineUuid == machineId && !conn.Detached() {
+			conn.DetachedAt = m.Now()
+			m.connections[id] = conn
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ResumeConnection(ctx context.Context, resumeToken string, userId string, machineId misc.MachineId, newResumeToken string) (Connection, misc.MachineId, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for id, conn := range m.connections {
+		if conn.resumeToken != resumeToken || conn.UserId != userId {
+			continue
+		}
+		if _, ok := m.machines[machineId]; !ok {
+			return Connection{}, misc.NilMachineId, violation(foreignKeyViolation, "connections_machine_uuid_fkey", "machine %s does not exist", machineId)
+		}
+		if m.resumeTokenTaken(newResumeToken, id) {
+			return Connection{}, misc.NilMachineId, violation(uniqueViolation, "idx_connections_resume_token", "resume token is already in use")
+		}
+
+		takenFrom := misc.NilMachineId
+		if !conn.Detached() {
+			takenFrom = conn.MachineUuid
+		}
+		conn.MachineUuid = machineId
+		conn.resumeToken = newResumeToken
+		conn.DetachedAt = time.Time{}
+		conn.LastUpdated = m.Now()
+		m.connections[id] = conn
+		return conn.Connection, takenFrom, nil
+	}
+	return Connection{}, misc.NilMachineId, ErrNotFound
+}
+
+// Rooms and their members
+
+func (m *Memory) roomsWhere(keep func(Room) bool) []Room {
+	rooms := []Room{}
+	for _, id := range sortedKeys(m.rooms) {
+		if keep(m.rooms[id]) {
+			rooms = append(rooms, m.rooms[id])
+		}
+	}
+	return rooms
+}
+
+func (m *Memory) GetRooms(ctx context.Context) ([]Room, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.roomsWhere(func(Room) bool { return true }), nil
+}
+
+func (m *Memory) GetOrphanedRooms(ctx context.Context, expiry time.Duration) ([]Room, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	since := m.Now().Add(-expiry)
+	return m.roomsWhere(func(room Room) bool {
+		machine, ok := m.machines[room.MachineUuid]
+		return !ok || machine.LastUpdated.Before(since)
+	}), nil
+}
+
+func (m *Memory) GetRoom(ctx context.Context, roomId misc.RoomId) (Room, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	room, ok := m.rooms[roomId]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	return room, nil
+}
+
+func (m *Memory) GetRoomsByMachine(ctx context.Context, machineId misc.MachineId) ([]Room, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.roomsWhere(func(room Room) bool { return room.MachineUuid == machineId }), nil
+}
+
+func (m *Memory) GetExpiredRooms(ctx context.Context) ([]Room, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.Now()
+	return m.roomsWhere(func(room Room) bool {
+		return !room.LeaseExpires.IsZero() && room.LeaseExpires.Before(now)
+	}), nil
+}
+
+func (m *Memory) CreateRoom(ctx context.Context, roomId misc.RoomId, machineId misc.MachineId, name string, script string, destroyOnOrphan bool, lease time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.rooms[roomId]; ok {
+		return violation(uniqueViolation, "rooms_pkey", "room %s already exists", roomId)
+	}
+	if _, ok := m.machines[machineId]; !ok {
+		return violation(foreignKeyViolation, "rooms_machine_uuid_fkey", "machine %s does not exist", machineId)
+	}
+
+	now := m.Now()
+	m.rooms[roomId] = Room{
+		Uuid:            roomId,
+		MachineUuid:     machineId,
+		Name:            name,
+		Script:          script,
+		DestroyOnOrphan: destroyOnOrphan,
+		CreatedAt:       now,
+		LastUpdated:     now,
+		Epoch:           1,
+		LeaseExpires:    now.Add(lease),
+	}
+	return nil
+}
+
+func (m *Memory) DeleteRoom(ctx context.Context, roomId misc.RoomId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.removeMembers(func(mem membership) bool { return mem.roomId == roomId })
+	delete(m.roomData, roomId)
+	delete(m.snapshots, roomId)
+	delete(m.rooms, roomId)
+	return nil
+}
+
+func (m *Memory) SetRoomOwner(ctx context.Context, roomId misc.RoomId, oldOwner misc.MachineId, newOwner misc.MachineId, lease time.Duration) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	room, ok := m.rooms[roomId]
+	if !ok || room.MachineUuid != oldOwner {
+		return 0, ErrNotFound
+	}
+	if _, ok := m.machines[newOwner]; !ok {
+		return 0, violation(foreignKeyViolation, "rooms_machine_uuid_fkey", "machine %s does not exist", newOwner)
+	}
+
+	room.MachineUuid = newOwner
+	room.Epoch++
+	room.LeaseExpires = m.Now().Add(lease)
+	m.rooms[roomId] = room
+	return room.Epoch, nil
+}
+
+func (m *Memory) RenewRoomLease(ctx context.Context, roomId misc.RoomId, machineId misc.MachineId, epoch int64, lease time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	room, ok := m.rooms[roomId]
+	if !ok || room.MachineUuid != machineId || room.Epoch != epoch {
+		return false, nil
+	}
+	room.LeaseExpires = m.Now().Add(lease)
+	m.rooms[roomId] = room
+	return true, nil
+}
+
+func (m *Memory) CheckRoomEpoch(ctx context.Context, roomId misc.RoomId, epoch int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	room, ok := m.rooms[roomId]
+	if !ok {
+		return ErrNotFound
+	}
+	return checkEpoch(roomId, room.Epoch, epoch)
+}
+
+func (m *Memory) GetRoomMembers(ctx context.Context, roomId misc.RoomId) ([]misc.ConnectionId, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := []misc.ConnectionId{}
+	for _, mem := range m.members {
+		if mem.roomId == roomId {
+			ret = append(ret, mem.connectionId)
+		}
+	}
+	return ret, nil
+}
+
+func (m *Memory) GetMembershipByConnection(ctx context.Context, connectionId misc.ConnectionId) ([]misc.ConnectionId, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := []misc.ConnectionId{}
+	for _, mem := range m.members {
+		if mem.connectionId == connectionId {
+			ret = append(ret, misc.ConnectionId(mem.roomId))
+		}
+	}
+	return ret, nil
+}
+
+func (m *Memory) AddRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.connections[connectionId]; !ok {
+		return violation(foreignKeyViolation, "room_membership_connection_uuid_fkey", "connection %s does not exist", connectionId)
+	}
+	if _, ok := m.rooms[roomId]; !ok {
+		return violation(foreignKeyViolation, "room_membership_room_uuid_fkey", "room %s does not exist", roomId)
+	}
+
+	add := membership{connectionId: connectionId, roomId: roomId}
+	for _, mem := range m.members {
+		if mem == add {
+			return nil
+		}
+	}
+	m.members = append(m.members, add)
+	return nil
+}
+
+func (m *Memory) RemoveRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.removeMembers(func(mem membership) bool { return mem.roomId == roomId && mem.connectionId == connectionId })
+	return nil
+}
+
+func (m *Memory) removeMembers(remove func(membership) bool) {
+	kept := []membership{}
+	for _, mem := range m.members {
+		if !remove(mem) {
+			kept = append(kept, mem)
+		}
+	}
+	m.members = kept
+}
+
+// Room storage and snapshots
+
+func (m *Memory) GetRoomData(ctx context.Context, roomId misc.RoomId) (map[string]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := map[string]string{}
+	for key, value := range m.roomData[roomId] {
+		ret[key] = value
+	}
+	return ret, nil
+}
+
+func (m *Memory) SetRoomData(ctx context.Context, roomId misc.RoomId, key string, value string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.rooms[roomId]; !ok {
+		return violation(foreignKeyViolation, "room_data_room_uuid_fkey", "room %s does not exist", roomId)
+	}
+	if m.roomData[roomId] == nil {
+		m.roomData[roomId] = map[string]string{}
+	}
+	m.roomData[roomId][key] = value
+	return nil
+}
+
+func (m *Memory) DeleteRoomData(ctx context.Context, roomId misc.RoomId, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.roomData[roomId], key)
+	return nil
+}
+
+func (m *Memory) DeleteAllRoomData(ctx context.Context, roomId misc.RoomId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.roomData, roomId)
+	return nil
+}
+
+func (m *Memory) GetRoomSnapshot(ctx context.Context, roomId misc.RoomId) (RoomSnapshot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snap, ok := m.snapshots[roomId]
+	if !ok {
+		return RoomSnapshot{}, ErrNotFound
+	}
+	return snap, nil
+}
+
+func (m *Memory) SaveRoomSnapshot(ctx context.Context, roomId misc.RoomId, state string, offset int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.rooms[roomId]; !ok {
+		return violation(foreignKeyViolation, "room_snapshots_room_uuid_fkey", "room %s does not exist", roomId)
+	}
+	m.snapshots[roomId] = RoomSnapshot{RoomId: roomId, State: state, Offset: offset, CreatedAt: m.Now()}
+	return nil
+}
+
+func (m *Memory) DeleteRoomSnapshot(ctx context.Context, roomId misc.RoomId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.snapshots, roomId)
+	return nil
+}
@@ -0,0 +1,252 @@
+package dbx
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestMemory has a machine M1 owning room R1, with connection C1 in it
+func newTestMemory(t *testing.T) *Memory {
+	t.Helper()
+	ctx := context.Background()
+	m := NewMemory()
+	mustDo(t, m.CreateMachine(ctx, "M1", "RoomServer"))
+	mustDo(t, m.CreateRoom(ctx, "R1", "M1", "room", "", false, time.Minute))
+	mustDo(t, m.CreateConnection(ctx, "C1", "M1", "user", "token"))
+	mustDo(t, m.AddRoomMember(ctx, "R1", "C1"))
+	mustDo(t, m.SetRoomData(ctx, "R1", "key", "value"))
+	return m
+}
+
+func TestMemoryConstraints(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name           string
+		do             func(m *Memory) error
+		wantCode       string
+		wantConstraint string
+	}{
+		{
+			name:           "duplicate machine",
+			do:             func(m *Memory) error { return m.CreateMachine(ctx, "M1", "RoomServer") },
+			wantCode:       uniqueViolation,
+			wantConstraint: "machines_pkey",
+		},
+		{
+			name:           "room on a missing machine",
+			do:             func(m *Memory) error { return m.CreateRoom(ctx, "R2", "M2", "room", "", false, time.Minute) },
+			wantCode:       foreignKeyViolation,
+			wantConstraint: "rooms_machine_uuid_fkey",
+		},
+		{
+			name:           "resume token in use",
+			do:             func(m *Memory) error { return m.CreateConnection(ctx, "C2", "M1", "user", "token") },
+			wantCode:       uniqueViolation,
+			wantConstraint: "idx_connections_resume_token",
+		},
+		{
+			name:           "deleting a machine that owns rooms",
+			do:             func(m *Memory) error { return m.DeleteMachine(ctx, "M1") },
+			wantCode:       foreignKeyViolation,
+			wantConstraint: "rooms_machine_uuid_fkey",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.do(newTestMemory(t))
+			var pgErr *pgconn.PgError
+			if !errors.As(err, &pgErr) {
+				t.Fatalf("err = %v, want a PgError", err)
+			}
+			if pgErr.Code != tt.wantCode || pgErr.ConstraintName != tt.wantConstraint {
+				t.Errorf("err = %s %s, want %s %s", pgErr.Code, pgErr.ConstraintName, tt.wantCode, tt.wantConstraint)
+			}
+		})
+	}
+}
+
+func TestMemoryDeleteRoomCascades(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory(t)
+
+	mustDo(t, m.DeleteRoom(ctx, "R1"))
+
+	_, err := m.GetRoom(ctx, "R1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRoom err = %v, want ErrNotFound", err)
+	}
+	rooms, err := m.GetMembershipByConnection(ctx, "C1")
+	mustDo(t, err)
+	if len(rooms) != 0 {
+		t.Errorf("C1 is still in %v", rooms)
+	}
+	data, err := m.GetRoomData(ctx, "R1")
+	mustDo(t, err)
+	if len(data) != 0 {
+		t.Errorf("room data is still %v", data)
+	}
+}
+
+func TestMemoryTouchReattaches(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory(t)
+
+	mustDo(t, m.DetachConnectionsByMachine(ctx, "M1"))
+	mustDo(t, m.TouchConnection(ctx, "C1", "M1"))
+
+	connections, err := m.GetConnectionsByMachine(ctx, "M1")
+	mustDo(t, err)
+	if len(connections) != 1 || connections[0].Detached() {
+		t.Errorf("connections = %v, want C1 attached", connections)
+	}
+}
+
+func TestMemoryOnlyTheOwnerTouches(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory(t)
+	mustDo(t, m.CreateMachine(ctx, "M2", "EUS"))
+
+	mustDo(t, m.DetachConnection(ctx, "C1", "M2"))
+	connections, err := m.GetConnectionsByMachine(ctx, "M1")
+	mustDo(t, err)
+	if len(connections) != 1 || connections[0].Detached() {
+		t.Fatalf("connections = %v, want C1 attached", connections)
+	}
+
+	mustDo(t, m.DetachConnection(ctx, "C1", "M1"))
+	mustDo(t, m.TouchConnection(ctx, "C1", "M2"))
+	connections, err = m.GetConnectionsByMachine(ctx, "M1")
+	mustDo(t, err)
+	if len(connections) != 1 || !connections[0].Detached() {
+		t.Errorf("connections = %v, want C1 detached", connections)
+	}
+}
+
+func TestMemoryResumeConnection(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name          string
+		detach        bool
+		token         string
+		user          string
+		wantErr       bool
+		wantTakenFrom misc.MachineId
+	}{
+		{name: "detached", detach: true, token: "token", user: "user", wantTakenFrom: misc.NilMachineId},
+		{name: "still attached is taken over", token: "token", user: "user", wantTakenFrom: "M1"},
+		{name: "wrong token", detach: true, token: "other", user: "user", wantErr: true},
+		{name: "wrong user", detach: true, token: "token", user: "mallory", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			mustDo(t, m.CreateMachine(ctx, "M2", "EUS"))
+			if tt.detach {
+				mustDo(t, m.DetachConnection(ctx, "C1", "M1"))
+			}
+
+			conn, takenFrom, err := m.ResumeConnection(ctx, tt.token, tt.user, "M2", "new token")
+			if tt.wantErr {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("err = %v, want ErrNotFound", err)
+				}
+				return
+			}
+			mustDo(t, err)
+			if conn.Uuid != "C1" || conn.MachineUuid != "M2" || conn.Detached() {
+				t.Errorf("conn = %+v", conn)
+			}
+			if takenFrom != tt.wantTakenFrom {
+				t.Errorf("taken from %q, want %q", takenFrom, tt.wantTakenFrom)
+			}
+			// The old token is spent
+			_, _, err = m.ResumeConnection(ctx, tt.token, tt.user, "M2", "newer token")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("resumed twice with one token, err = %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryWithTx(t *testing.T) {
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name     string
+		fn       func(t *testing.T, q QueriesX) error
+		wantErr  error
+		wantData map[string]string
+	}{
+		{
+			name: "committed",
+			fn: func(t *testing.T, q QueriesX) error {
+				return q.SetRoomData(ctx, "R1", "key", "changed")
+			},
+			wantData: map[string]string{"key": "changed"},
+		},
+		{
+			name: "rolled back",
+			fn: func(t *testing.T, q QueriesX) error {
+				mustDo(t, q.SetRoomData(ctx, "R1", "key", "changed"))
+				mustDo(t, q.SetRoomData(ctx, "R1", "other", "new"))
+				mustDo(t, q.DeleteRoom(ctx, "R1"))
+				return errFailed
+			},
+			wantErr:  errFailed,
+			wantData: map[string]string{"key": "value"},
+		},
+		{
+			name: "a stale epoch rolls back",
+			fn: func(t *testing.T, q QueriesX) error {
+				mustDo(t, q.DeleteRoomData(ctx, "R1", "key"))
+				return q.CheckRoomEpoch(ctx, "R1", 0)
+			},
+			wantErr:  ErrStaleEpoch,
+			wantData: map[string]string{"key": "value"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+
+			err := m.WithTx(ctx, func(q QueriesX) error { return tt.fn(t, q) })
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			_, err = m.GetRoom(ctx, "R1")
+			mustDo(t, err)
+			data, err := m.GetRoomData(ctx, "R1")
+			mustDo(t, err)
+			if len(data) != len(tt.wantData) {
+				t.Errorf("room data = %v, want %v", data, tt.wantData)
+			}
+			for key, value := range tt.wantData {
+				if data[key] != value {
+					t.Errorf("room data = %v, want %v", data, tt.wantData)
+				}
+			}
+			members, err := m.GetRoomMembers(ctx, "R1")
+			mustDo(t, err)
+			if !slices.Equal(members, []misc.ConnectionId{"C1"}) {
+				t.Errorf("members = %v, want [C1]", members)
+			}
+		})
+	}
+}
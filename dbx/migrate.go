@@ -0,0 +1,159 @@
+package dbx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/hoyle1974/chorus/db/migrations"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+/*
+ * The schema is brought up to date by Migrate, which RoomServer and
+ * EndUserServer run when they start and `chorus migrate` runs by hand.  It
+ * keeps its place in the same schema_migrations table the migrate CLI used,
+ * so databases set up with that carry on from where they are.
+ *
+ * Each migration runs in a transaction along with the version it moves the
+ * schema to, and the whole run holds an advisory lock so servers starting
+ * together don't apply the same migration twice.
+ */
+
+var (
+	ErrSchemaTooOld = errors.New("database schema is older than this build, run chorus migrate")
+	ErrSchemaTooNew = errors.New("database schema is newer than this build")
+	ErrSchemaDirty  = errors.New("database schema is dirty, a migration stopped part way")
+)
+
+const migrateLockKey = "chorus.migrate"
+
+// Migrate applies the migrations the database hasn't had yet, creating the
+// database first if it doesn't exist
+func Migrate(ctx context.Context, logger *slog.Logger) error {
+	conn, err := connectCreatingDatabase(ctx, logger)
+	if err != nil {
+		return err
+	}
+	// Closing the session lets go of the lock
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", migrateLockKey)
+	if err != nil {
+		return fmt.Errorf("lock for migration: %w", err)
+	}
+
+	_, err = conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	version, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if version > migrations.Latest() {
+		return fmt.Errorf("%w: database is at %d, we know up to %d", ErrSchemaTooNew, version, migrations.Latest())
+	}
+
+	up, err := migrations.Up()
+	if err != nil {
+		return err
+	}
+	for _, m := range up {
+		if m.Version <= version {
+			continue
+		}
+		logger.Info("Migrating", "version", m.Version, "name", m.Name)
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, m.SQL)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM schema_migrations")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// CheckSchema returns an error unless the database is at exactly the
+// version this build was written against
+func CheckSchema(ctx context.Context) error {
+	conn, err := GetConn().Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	version, err := schemaVersion(ctx, conn.Conn())
+	if err != nil {
+		return err
+	}
+	switch {
+	case version < migrations.Latest():
+		return fmt.Errorf("%w: database is at %d, we need %d", ErrSchemaTooOld, version, migrations.Latest())
+	case version > migrations.Latest():
+		return fmt.Errorf("%w: database is at %d, we know up to %d", ErrSchemaTooNew, version, migrations.Latest())
+	}
+	return nil
+}
+
+// schemaVersion is the last migration applied, 0 for a database that has
+// never been migrated
+func schemaVersion(ctx context.Context, conn *pgx.Conn) (int64, error) {
+	var version int64
+	var dirty bool
+	err := conn.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	var pgErr *pgconn.PgError
+	if errors.Is(err, pgx.ErrNoRows) || (errors.As(err, &pgErr) && pgErr.Code == "42P01") {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return version, fmt.Errorf("%w at %d", ErrSchemaDirty, version)
+	}
+	return version, nil
+}
+
+// connectCreatingDatabase connects to the configured database, creating it
+// from the postgres database if it isn't there
+func connectCreatingDatabase(ctx context.Context, logger *slog.Logger) (*pgx.Conn, error) {
+	cfg, err := pgx.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "3D000" {
+		return conn, err
+	}
+
+	logger.Info("Creating database", "database", cfg.Database)
+	admin := cfg.Copy()
+	admin.Database = "postgres"
+	adminConn, err := pgx.ConnectConfig(ctx, admin)
+	if err != nil {
+		return nil, err
+	}
+	_, err = adminConn.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{cfg.Database}.Sanitize())
+	adminConn.Close(context.Background())
+	// 42P04 is another server creating it at the same time
+	if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == "42P04") {
+		return nil, err
+	}
+
+	return pgx.ConnectConfig(ctx, cfg)
+}
@@ -0,0 +1,40 @@
+package dbx
+
+import (
+	"context"
+
+	"github.com/hoyle1974/chorus/db"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+func (r postgresQueries) GetRoomData(ctx context.Context, roomId misc.RoomId) (map[string]string, error) {
+	ret := map[string]string{}
+
+	rows, err := r.q.GetRoomData(ctx, text(string(roomId)))
+	if err != nil {
+		return ret, err
+	}
+	for _, row := range rows {
+		ret[row.Key] = row.Value.String
+	}
+	return ret, nil
+}
+
+func (r postgresQueries) SetRoomData(ctx context.Context, roomId misc.RoomId, key string, value string) error {
+	return r.q.SetRoomData(ctx, db.SetRoomDataParams{
+		RoomUuid: text(string(roomId)),
+		Key:      key,
+		Value:    text(value),
+	})
+}
+
+func (r postgresQueries) DeleteRoomData(ctx context.Context, roomId misc.RoomId, key string) error {
+	return r.q.DeleteRoomData(ctx, db.DeleteRoomDataParams{
+		RoomUuid: text(string(roomId)),
+		Key:      key,
+	})
+}
+
+func (r postgresQueries) DeleteAllRoomData(ctx context.Context, roomId misc.RoomId) error {
+	return r.q.DeleteAllRoomData(ctx, text(string(roomId)))
+}
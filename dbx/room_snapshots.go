@@ -0,0 +1,40 @@
+package dbx
+
+import (
+	"context"
+	"time"
+
+	"github.com/hoyle1974/chorus/db"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+type RoomSnapshot struct {
+	RoomId misc.RoomId
+	State  string
+	// Offset in the room's topic of the first message after the snapshot
+	Offset    int64
+	CreatedAt time.Time
+}
+
+// GetRoomSnapshot returns ErrNotFound if the room has never been snapshotted
+func (r postgresQueries) GetRoomSnapshot(ctx context.Context, roomId misc.RoomId) (RoomSnapshot, error) {
+	row, err := r.q.GetRoomSnapshot(ctx, string(roomId))
+	return RoomSnapshot{
+		RoomId:    misc.RoomId(row.RoomUuid),
+		State:     row.State,
+		Offset:    row.TopicOffset,
+		CreatedAt: row.CreatedAt.Time,
+	}, notFound(err)
+}
+
+func (r postgresQueries) SaveRoomSnapshot(ctx context.Context, roomId misc.RoomId, state string, offset int64) error {
+	return r.q.SaveRoomSnapshot(ctx, db.SaveRoomSnapshotParams{
+		RoomUuid:    string(roomId),
+		State:       state,
+		TopicOffset: offset,
+	})
+}
+
+func (r postgresQueries) DeleteRoomSnapshot(ctx context.Context, roomId misc.RoomId) error {
+	return r.q.DeleteRoomSnapshot(ctx, string(roomId))
+}
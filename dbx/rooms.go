@@ -2,12 +2,16 @@ package dbx
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/hoyle1974/chorus/db"
 	"github.com/hoyle1974/chorus/misc"
 )
 
+var ErrStaleEpoch = errors.New("stale room epoch")
+
 type Room struct {
 	Uuid            misc.RoomId
 	MachineUuid     misc.MachineId
@@ -16,6 +20,8 @@ type Room struct {
 	DestroyOnOrphan bool
 	CreatedAt       time.Time
 	LastUpdated     time.Time
+	Epoch           int64
+	LeaseExpires    time.Time
 }
 
 func toRoom(in db.Room) Room {
@@ -27,11 +33,13 @@ func toRoom(in db.Room) Room {
 		DestroyOnOrphan: in.DestroyOnOrphan,
 		CreatedAt:       in.CreatedAt.Time,
 		LastUpdated:     in.LastUpdated.Time,
+		Epoch:           in.Epoch,
+		LeaseExpires:    in.LeaseExpires.Time,
 	}
 }
 
-func (r QueriesX) GetRooms() ([]Room, error) {
-	rows, err := r.q.GetRooms(context.Background())
+func (r postgresQueries) GetRooms(ctx context.Context) ([]Room, error) {
+	rows, err := r.q.GetRooms(ctx)
 	rooms := []Room{}
 	if err != nil {
 		return rooms, err
@@ -42,8 +50,10 @@ func (r QueriesX) GetRooms() ([]Room, error) {
 	return rooms, err
 }
 
-func (r QueriesX) GetOrphanedRooms() ([]Room, error) {
-	rows, err := r.q.GetOrphanedRooms(context.Background())
+// GetOrphanedRooms returns the rooms whose owner hasn't touched its machine
+// record within expiry
+func (r postgresQueries) GetOrphanedRooms(ctx context.Context, expiry time.Duration) ([]Room, error) {
+	rows, err := r.q.GetOrphanedRooms(ctx, interval(expiry))
 	rooms := []Room{}
 	if err != nil {
 		return rooms, err
@@ -54,8 +64,13 @@ func (r QueriesX) GetOrphanedRooms() ([]Room, error) {
 	return rooms, err
 }
 
-func (r QueriesX) GetRoomsByMachine(machineId misc.MachineId) ([]Room, error) {
-	rows, err := r.q.GetRoomsByMachine(context.Background(), string(machineId))
+func (r postgresQueries) GetRoom(ctx context.Context, roomId misc.RoomId) (Room, error) {
+	row, err := r.q.GetRoom(ctx, string(roomId))
+	return toRoom(row), notFound(err)
+}
+
+func (r postgresQueries) GetRoomsByMachine(ctx context.Context, machineId misc.MachineId) ([]Room, error) {
+	rows, err := r.q.GetRoomsByMachine(ctx, string(machineId))
 	rooms := []Room{}
 	if err != nil {
 		return rooms, err
@@ -66,24 +81,29 @@ func (r QueriesX) GetRoomsByMachine(machineId misc.MachineId) ([]Room, error) {
 	return rooms, err
 }
 
-func (r QueriesX) CreateRoom(roomId misc.RoomId, machineId misc.MachineId, name string, script string, destroyOnOrphan bool) error {
-	return r.q.CreateRoom(context.Background(), db.CreateRoomParams{
+// CreateRoom creates a room owned by machineId, at epoch 1, with a lease
+// that runs for lease
+func (r postgresQueries) CreateRoom(ctx context.Context, roomId misc.RoomId, machineId misc.MachineId, name string, script string, destroyOnOrphan bool, lease time.Duration) error {
+	return r.q.CreateRoom(ctx, db.CreateRoomParams{
 		Uuid:            string(roomId),
 		MachineUuid:     string(machineId),
 		Name:            name,
 		Script:          script,
 		DestroyOnOrphan: destroyOnOrphan,
+		Lease:           interval(lease),
 	})
 }
 
-func (r QueriesX) DeleteRoom(roomId misc.RoomId) {
-	r.q.DeleteRoom(context.Background(), string(roomId))
+// DeleteRoom deletes a room with its members, data and snapshot, all in one
+// statement so nothing is left behind if it fails part way
+func (r postgresQueries) DeleteRoom(ctx context.Context, roomId misc.RoomId) error {
+	return r.q.DeleteRoom(ctx, string(roomId))
 }
 
-func (r QueriesX) GetRoomMembers(roomId misc.RoomId) ([]misc.ConnectionId, error) {
+func (r postgresQueries) GetRoomMembers(ctx context.Context, roomId misc.RoomId) ([]misc.ConnectionId, error) {
 	ret := []misc.ConnectionId{}
 
-	rows, err := r.q.GetRoomMembers(context.Background(), string(roomId))
+	rows, err := r.q.GetRoomMembers(ctx, string(roomId))
 	if err != nil {
 		return ret, err
 	}
@@ -94,28 +114,81 @@ func (r QueriesX) GetRoomMembers(roomId misc.RoomId) ([]misc.ConnectionId, error
 	return ret, nil
 }
 
-func (r QueriesX) AddRoomMember(roomId misc.RoomId, connectionId misc.ConnectionId) {
-	r.q.AddRoomMember(context.Background(), db.AddRoomMemberParams{
+// AddRoomMember makes connectionId a member of roomId, it does nothing if it
+// already is one
+func (r postgresQueries) AddRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error {
+	return r.q.AddRoomMember(ctx, db.AddRoomMemberParams{
 		RoomUuid:       string(roomId),
 		ConnectionUuid: string(connectionId),
 	})
 }
 
-func (r QueriesX) RemoveRoomMember(roomId misc.RoomId, connectionId misc.ConnectionId) {
-	r.q.RemoveRoomMember(context.Background(), db.RemoveRoomMemberParams{
+func (r postgresQueries) RemoveRoomMember(ctx context.Context, roomId misc.RoomId, connectionId misc.ConnectionId) error {
+	return r.q.RemoveRoomMember(ctx, db.RemoveRoomMemberParams{
 		RoomUuid:       string(roomId),
 		ConnectionUuid: string(connectionId),
 	})
 }
 
-func (r QueriesX) SetRoomOwner(roomId misc.RoomId, oldOwner misc.MachineId, newOwner misc.MachineId) error {
-	return r.q.SetRoomOwner(context.Background(), db.SetRoomOwnerParams{string(roomId), string(newOwner), string(oldOwner)})
+// SetRoomOwner moves a room from oldOwner to newOwner with a fresh lease and
+// returns the room's new epoch.  It returns ErrNotFound if oldOwner no
+// longer has the room.
+func (r postgresQueries) SetRoomOwner(ctx context.Context, roomId misc.RoomId, oldOwner misc.MachineId, newOwner misc.MachineId, lease time.Duration) (int64, error) {
+	epoch, err := r.q.SetRoomOwner(ctx, db.SetRoomOwnerParams{
+		NewOwner: string(newOwner),
+		Lease:    interval(lease),
+		Uuid:     string(roomId),
+		OldOwner: string(oldOwner),
+	})
+	return epoch, notFound(err)
+}
+
+// RenewRoomLease extends the lease on a room, false means the machine has
+// lost the room to a later epoch
+func (r postgresQueries) RenewRoomLease(ctx context.Context, roomId misc.RoomId, machineId misc.MachineId, epoch int64, lease time.Duration) (bool, error) {
+	rows, err := r.q.RenewRoomLease(ctx, db.RenewRoomLeaseParams{
+		Lease:       interval(lease),
+		Uuid:        string(roomId),
+		MachineUuid: string(machineId),
+		Epoch:       epoch,
+	})
+	return rows == 1, err
+}
+
+// CheckRoomEpoch returns an error if the room has moved past epoch.  Inside
+// a transaction it also holds off any change of owner until the transaction
+// ends, so writes made after it are fenced.
+func (r postgresQueries) CheckRoomEpoch(ctx context.Context, roomId misc.RoomId, epoch int64) error {
+	current, err := r.q.GetRoomEpochForShare(ctx, string(roomId))
+	if err != nil {
+		return notFound(err)
+	}
+	return checkEpoch(roomId, current, epoch)
+}
+
+func checkEpoch(roomId misc.RoomId, current int64, epoch int64) error {
+	if current != epoch {
+		return fmt.Errorf("%w: room %s is at epoch %d, not %d", ErrStaleEpoch, roomId, current, epoch)
+	}
+	return nil
+}
+
+func (r postgresQueries) GetExpiredRooms(ctx context.Context) ([]Room, error) {
+	rows, err := r.q.GetExpiredRooms(ctx)
+	rooms := []Room{}
+	if err != nil {
+		return rooms, err
+	}
+	for _, dbRoom := range rows {
+		rooms = append(rooms, toRoom(dbRoom))
+	}
+	return rooms, err
 }
 
-func (r QueriesX) GetMembershipByConnection(connectionId misc.ConnectionId) ([]misc.ConnectionId, error) {
+func (r postgresQueries) GetMembershipByConnection(ctx context.Context, connectionId misc.ConnectionId) ([]misc.ConnectionId, error) {
 	ret := []misc.ConnectionId{}
 
-	rows, err := r.q.GetMembershipByConnection(context.Background(), string(connectionId))
+	rows, err := r.q.GetMembershipByConnection(ctx, string(connectionId))
 	if err == nil {
 		for _, row := range rows {
 			ret = append(ret, misc.ConnectionId(row))
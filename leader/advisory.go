@@ -0,0 +1,108 @@
+package leader
+
+import (
+	"context"
+	"time"
+
+	"github.com/hoyle1974/chorus/db"
+	"github.com/hoyle1974/chorus/dbx"
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * The advisory backend makes whoever holds a Postgres advisory lock, keyed
+ * on the machine type, the leader.  The lock belongs to a database session
+ * the leader keeps for itself, so when the leader dies or its session
+ * drops, Postgres lets go of the lock and the next machine to try gets it.
+ * There is no leader row or timestamp to race on.
+ *
+ * The leader pings its session every tick.  If that fails it may no longer
+ * hold the lock, so it stops leading, calls onLeadershipLost and goes back
+ * to trying for the lock on a new session.
+ */
+
+// advisoryElection runs until ctx is cancelled by StepDown
+func (ms LeaderService) advisoryElection(ctx context.Context) {
+	ms.logger.Debug("advisoryElection")
+	defer close(ms.done)
+
+	for ctx.Err() == nil {
+		conn, err := dbx.NewConn()
+		if err != nil {
+			ms.logger.Error("Could not connect for leader election", "error", err)
+			sleep(ctx, electionRetryInterval)
+			continue
+		}
+		ms.holdAdvisoryLock(ctx, conn)
+		conn.Close(context.Background())
+	}
+}
+
+// holdAdvisoryLock waits to take the lock on conn and then leads for as long
+// as the session keeps it
+func (ms LeaderService) holdAdvisoryLock(ctx context.Context, conn *pgx.Conn) {
+	q := dbx.Dbx().Queries(db.New(conn))
+
+	for {
+		ok, err := q.TryLeaderLock(ctx, ms.machineType)
+		if err != nil {
+			ms.logger.Error("Could not try for the leader lock", "error", err)
+			return
+		}
+		if ok {
+			break
+		}
+		if !sleep(ctx, electionRetryInterval) {
+			return
+		}
+	}
+
+	ms.logger.Info("We are the leader")
+	leadCtx, stopLeading := context.WithCancel(ctx)
+	defer stopLeading()
+	lqc := leaderQueryContextImpl{
+		logger:      ms.logger.With("leader", true),
+		machineId:   ms.machineId,
+		machineType: ms.machineType,
+		liveness:    ms.liveness,
+		database:    ms.database,
+		q:           q,
+		ctx:         leadCtx,
+	}
+	ms.onLeaderStart(lqc)
+	leading.WithLabelValues(ms.machineType).Set(1)
+	defer leading.WithLabelValues(ms.machineType).Set(0)
+
+	for {
+		if !sleep(ctx, ms.liveness.LeaderTick) {
+			// Let the next machine in without waiting for the session to close
+			_, err := q.ReleaseLeaderLock(context.Background(), ms.machineType)
+			if err != nil {
+				lqc.logger.Warn("Could not release the leader lock", "error", err)
+			}
+			return
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, time.Duration(5)*time.Second)
+		err := conn.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			lqc.logger.Error("Lost our leader session", "error", err)
+			stopLeading()
+			ms.lost(lqc)
+			return
+		}
+
+		ms.tick(lqc)
+	}
+}
+
+// sleep waits for d, it returns false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -3,9 +3,11 @@ package leader
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"time"
 
+	"github.com/hoyle1974/chorus/config"
 	"github.com/hoyle1974/chorus/db"
 	"github.com/hoyle1974/chorus/dbx"
 	"github.com/hoyle1974/chorus/misc"
@@ -18,235 +20,336 @@ import (
  *
  * Not leader - watches the leader to make sure it updates the table,
  * if it does not, it tries ot become the leader
+ *
+ * A leader that finds its leader row gone or its own record going stale
+ * stops, calls onLeadershipLost and goes back to waiting.
+ *
+ * How the leader is picked depends on the Backend, every machine of a type
+ * must use the same one.  Elections need Postgres sessions of their own, for
+ * LISTEN and advisory locks, everything else goes through the Database the
+ * LeaderContext gives us.
  */
 
+type Backend string
+
+const (
+	// BackendTable keeps the leader in the machine_type_leader table
+	BackendTable Backend = "table"
+	// BackendAdvisory holds a Postgres advisory lock, see advisory.go
+	BackendAdvisory Backend = "advisory"
+)
+
 type LeaderContext interface {
 	Logger() *slog.Logger
 	MachineId() misc.MachineId
 	MachineType() string
+	Liveness() config.Liveness
+	Database() dbx.Database
 }
 
 type LeaderService struct {
-	dbx              dbx.DBX
+	database         dbx.Database
 	machineId        misc.MachineId
 	logger           *slog.Logger
 	machineType      string
+	liveness         config.Liveness
 	onLeaderStart    onLeader
 	onLeaderTick     onLeader
 	onMachineOffline onMachineOffline
+	onLeadershipLost onLeader
+	cancel           context.CancelFunc
+	done             chan struct{} // closed when the election has stopped
+}
+
+// electionRetryInterval is how long to wait after the database lets us down
+const electionRetryInterval = time.Duration(1) * time.Second
+
+// StepDown stops leading, or trying to lead, and waits until another machine
+// is free to take over.  It is for a graceful shutdown.
+func (ms LeaderService) StepDown() {
+	ms.cancel()
+	<-ms.done
 }
 
 func (ms LeaderService) Destroy() error {
-	q := dbx.Dbx().Queries(db.New(dbx.GetConn()))
-	err := q.DeleteMachine(ms.machineId)
-	return err
+	ms.StepDown()
+	return ms.database.Queries().DeleteMachine(context.Background(), ms.machineId)
 }
 
 type LeaderQueryContext interface {
 	LeaderContext
 	Query() dbx.QueriesX
+	// Context is cancelled when we stop leading, whether we stepped down
+	// or lost leadership.  onLeadershipLost is given it already cancelled.
+	Context() context.Context
 }
 
 type leaderQueryContextImpl struct {
 	logger      *slog.Logger
 	machineId   misc.MachineId
 	machineType string
+	liveness    config.Liveness
+	database    dbx.Database
 	q           dbx.QueriesX
+	ctx         context.Context
 }
 
 func (l leaderQueryContextImpl) Logger() *slog.Logger      { return l.logger }
 func (l leaderQueryContextImpl) MachineId() misc.MachineId { return l.machineId }
 func (l leaderQueryContextImpl) MachineType() string       { return l.machineType }
+func (l leaderQueryContextImpl) Liveness() config.Liveness { return l.liveness }
+func (l leaderQueryContextImpl) Database() dbx.Database    { return l.database }
 func (l leaderQueryContextImpl) Query() dbx.QueriesX       { return l.q }
+func (l leaderQueryContextImpl) Context() context.Context  { return l.ctx }
 
 type onLeader func(ctx LeaderQueryContext)
 type onMachineOffline func(ctx LeaderQueryContext, machineId misc.MachineId)
 
-func StartLeaderService(ctx LeaderContext, onLeaderStart onLeader, onLeaderTick onLeader, onMachineOffline onMachineOffline) (LeaderService, error) {
+// StartLeaderService registers this machine and runs leader election for its
+// type.  onLeadershipLost is called if we stop being the leader while the
+// process is still running.
+func StartLeaderService(ctx LeaderContext, backend Backend, onLeaderStart onLeader, onLeaderTick onLeader, onMachineOffline onMachineOffline, onLeadershipLost onLeader) (LeaderService, error) {
+	electionCtx, cancel := context.WithCancel(context.Background())
 	ms := LeaderService{
-		logger:           ctx.Logger().With("machineId", ctx.MachineId(), "type", ctx.MachineType()),
+		logger:           ctx.Logger().With("machineId", ctx.MachineId(), "type", ctx.MachineType(), "backend", backend),
 		machineId:        ctx.MachineId(),
-		dbx:              dbx.Dbx(),
+		database:         ctx.Database(),
 		machineType:      ctx.MachineType(),
+		liveness:         ctx.Liveness(),
 		onLeaderStart:    onLeaderStart,
 		onLeaderTick:     onLeaderTick,
 		onMachineOffline: onMachineOffline,
+		onLeadershipLost: onLeadershipLost,
+		cancel:           cancel,
+		done:             make(chan struct{}),
 	}
 	defer ms.logger.Info("Leader Service Started . . .")
 
 	// Create ourselves as a machine in the table
-	q := dbx.Dbx().Queries(db.New(dbx.GetConn()) /*.WithTx(tx)*/)
-	err := q.CreateMachine(ctx.MachineId(), ctx.MachineType())
+	err := ms.database.Queries().CreateMachine(context.Background(), ctx.MachineId(), ctx.MachineType())
 	if err != nil {
 		return ms, err
 	}
 	go ms.keepAliveTick()
 
-	// Start transaction
-	tx, err := dbx.GetConn().Begin(context.Background())
-	if err != nil {
-		return ms, err
-	}
-	defer tx.Rollback(context.Background())
-
-	q = dbx.Dbx().Queries(db.New(dbx.GetConn()).WithTx(tx))
-
-	leaderMachineId := q.GetLeaderForType(ctx.MachineType())
-	if leaderMachineId == misc.NilMachineId {
-		// Let's become the leader
-		err := q.SetMachineAsLeader(ctx.MachineId())
-		if err == nil {
-			// We are the leader
-			ms.becomeLeader(q)
-			err = tx.Commit(context.Background())
-			return ms, err
-		}
-	}
-	err = tx.Commit(context.Background())
-	if err != nil {
-		return ms, err
+	if backend == BackendAdvisory {
+		go ms.advisoryElection(electionCtx)
+	} else {
+		go ms.tableElection(electionCtx)
 	}
-
-	go ms.waitForLeader()
 	return ms, nil
 }
 
 func (ms LeaderService) keepAliveTick() {
 	ms.logger.Debug("keepAliveTick")
-	conn, err := dbx.NewConn()
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close(context.Background())
-	q := db.New(conn)
-
 	for {
-		err := ms.dbx.Queries(q).TouchMachine(ms.machineId)
+		// Each touch takes whatever pool connection is free, a dropped
+		// one only costs a heartbeat
+		touchCtx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
+		err := ms.database.Queries().TouchMachine(touchCtx, ms.machineId)
+		cancel()
 		if err != nil {
 			ms.logger.Error("Could not touch our record in the database", "error", err)
 		}
-		time.Sleep(time.Second * time.Duration(1))
+		time.Sleep(ms.liveness.Heartbeat)
 	}
 }
 
-func (ms LeaderService) becomeLeader(q dbx.QueriesX) {
-	ms.logger.Info("We are the leader")
-	ms.logger = ms.logger.With("leader", true)
-	go ms.monitorLeadership()
+// tableElection waits to become the leader and leads until it loses it,
+// over and over until StepDown
+func (ms LeaderService) tableElection(ctx context.Context) {
+	defer close(ms.done)
+
+	for ctx.Err() == nil {
+		if ms.waitForLeader(ctx) {
+			ms.monitorLeadership(ctx)
+		}
+	}
 }
 
-func (ms LeaderService) monitorLeadership() {
-	ms.logger.Debug("leader")
+func (ms LeaderService) monitorLeadership(ctx context.Context) {
+	logger := ms.logger.With("leader", true)
+	logger.Info("We are the leader")
 
 	conn, err := dbx.NewConn()
 	if err != nil {
-		panic(err)
+		logger.Error("Could not connect to lead", "error", err)
+		sleep(ctx, electionRetryInterval)
+		return
 	}
+	defer conn.Close(context.Background())
 	q := dbx.Dbx().Queries(db.New(conn))
 
+	leadCtx, stopLeading := context.WithCancel(ctx)
+	defer stopLeading()
 	lqc := leaderQueryContextImpl{
-		logger:      ms.logger,
+		logger:      logger,
 		machineId:   ms.machineId,
 		machineType: ms.machineType,
+		liveness:    ms.liveness,
+		database:    ms.database,
 		q:           q,
+		ctx:         leadCtx,
 	}
 	ms.onLeaderStart(lqc)
+	leading.WithLabelValues(ms.machineType).Set(1)
+	defer leading.WithLabelValues(ms.machineType).Set(0)
 
 	for {
-		time.Sleep(time.Duration(1) * time.Second)
-		machines, err := q.GetMachinesByType(ms.machineType)
-		now := time.Now()
-		if err == nil {
-			for _, machine := range machines {
-				if now.Sub(machine.LastUpdated).Seconds() > 5 {
-					ms.logger.Debug("Delete machine", "machineToDelete", machine.Uuid)
-					ms.onMachineOffline(lqc, machine.Uuid)
-					err := q.DeleteMachine(machine.Uuid)
-					if err != nil {
-						ms.logger.Error("Problem deleting machine", "error", err)
-					}
-				}
+		if !sleep(ctx, ms.liveness.LeaderTick) {
+			// Stepping down, let the next machine in
+			err := q.DeleteLeader(context.Background(), ms.machineId)
+			if err != nil {
+				logger.Warn("Could not give up leadership", "error", err)
 			}
-		} else {
-			ms.logger.Error("Trouble getting a list of all machines", "error", err)
+			return
+		}
+
+		err := ms.stillLeader(ctx, q)
+		if err != nil {
+			logger.Error("Lost leadership", "error", err)
+			// In case the row is still ours, nobody should follow it
+			q.DeleteLeader(ctx, ms.machineId)
+			stopLeading()
+			ms.lost(lqc)
+			return
 		}
 
-		ms.onLeaderTick(lqc)
+		ms.tick(lqc)
+	}
+}
+
+// stillLeader checks what the other machines look at to decide who leads:
+// the leader row and how recently we touched our machine record
+func (ms LeaderService) stillLeader(ctx context.Context, q dbx.QueriesX) error {
+	leaderId := q.GetLeaderForType(ctx, ms.machineType)
+	if leaderId != ms.machineId {
+		return fmt.Errorf("the leader row is %q", leaderId)
+	}
+	return ms.alive(ctx, q)
+}
 
+// alive returns an error if the other machines would think we are gone
+func (ms LeaderService) alive(ctx context.Context, q dbx.QueriesX) error {
+	machine, err := q.GetMachine(ctx, ms.machineId)
+	if err != nil {
+		return fmt.Errorf("could not read our machine record: %w", err)
 	}
+	if time.Since(machine.LastUpdated) > ms.liveness.MachineExpiry {
+		return fmt.Errorf("our machine record was last touched %v ago", time.Since(machine.LastUpdated))
+	}
+	return nil
 }
 
-// We are not the leader, but wait to see if we can become a leader
-func (ms LeaderService) waitForLeader() {
+// expireMachines deletes machines that have stopped touching their record,
+// after giving onMachineOffline a chance to clean up after them
+func (ms LeaderService) expireMachines(lqc leaderQueryContextImpl) {
+	machines, err := lqc.q.GetMachinesByType(lqc.ctx, ms.machineType)
+	if err != nil {
+		lqc.logger.Error("Trouble getting a list of all machines", "error", err)
+		return
+	}
+	now := time.Now()
+	for _, machine := range machines {
+		if now.Sub(machine.LastUpdated) > ms.liveness.MachineExpiry {
+			lqc.logger.Debug("Delete machine", "machineToDelete", machine.Uuid)
+			ms.onMachineOffline(lqc, machine.Uuid)
+			err := lqc.q.DeleteMachine(lqc.ctx, machine.Uuid)
+			if err != nil {
+				lqc.logger.Error("Problem deleting machine", "error", err)
+			}
+		}
+	}
+}
+
+// We are not the leader, but wait to see if we can become a leader.  It
+// returns true once we are.
+func (ms LeaderService) waitForLeader(ctx context.Context) bool {
 	ms.logger.Debug("waitForLeader")
 
 	conn, err := dbx.NewConn()
 	if err != nil {
-		panic(err)
+		ms.logger.Error("Could not connect to wait for the leader", "error", err)
+		sleep(ctx, electionRetryInterval)
+		return false
 	}
+	defer conn.Close(context.Background())
 
-	// Listen to a channel named "my_channel"
-	_, err = conn.Exec(context.Background(), "LISTEN machines")
+	// Every machine touching its record wakes us up
+	_, err = conn.Exec(ctx, "LISTEN machines")
 	if err != nil {
-		panic(err)
+		ms.logger.Error("Could not listen for machine updates", "error", err)
+		sleep(ctx, electionRetryInterval)
+		return false
 	}
+	q := dbx.Dbx().Queries(db.New(conn))
 
 	for {
-		ctx, _ := context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
-		_, err := conn.WaitForNotification(ctx)
-		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		if ms.tryToLead(ctx, q) {
+			return true
+		}
 
-			// Start transaction
-			tx, err := dbx.GetConn().Begin(context.Background())
-			if err != nil {
-				ms.logger.Error("Could not get connection", "error", err)
-			}
-			conn := dbx.GetConn()
-			dbq := db.New(conn)
-			q := dbx.Dbx().Queries(dbq)
-
-			// Timeout occured, the monleaderitor is no longer valid, let's become the leader
-			machineId := q.GetLeaderForType(ms.machineType)
-			if machineId != misc.NilMachineId {
-				machine, err := q.GetMachine(machineId)
-				if err == nil {
-					// Leader machine has timed out
-					if time.Since(machine.LastUpdated).Seconds() > 5 {
-						ms.logger.Warn("Leader deadline exceeded, let's try to become the leader now")
-
-						lqc := leaderQueryContextImpl{
-							logger:      ms.logger,
-							machineId:   ms.machineId,
-							machineType: ms.machineType,
-							q:           q,
-						}
-						ms.onMachineOffline(lqc, machine.Uuid)
-						err = q.DeleteMachine(machineId)
-						if err == nil {
-							err := q.SetMachineAsLeader(ms.machineId)
-							if err == nil {
-								ms.becomeLeader(q)
-								err = tx.Commit(context.Background())
-								if err != nil {
-									panic(err)
-								}
-								return
-							} else {
-								ms.logger.Error("could not become the leader", "error", err)
-							}
-						} else {
-							ms.logger.Error("could not delete expired leader", "error", err)
-						}
-					}
-				}
-			} else {
-				ms.logger.Error("could not get a leader", "error", err)
-			}
-			tx.Rollback(context.Background())
-		} else {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Duration(5)*time.Second)
+		_, err := conn.WaitForNotification(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
 			ms.logger.Error("Error waiting for notification", "error", err)
-			panic(err)
+			return false
 		}
 	}
+}
 
+// tryToLead makes us the leader if there is none, or the leader has stopped
+// touching its record
+func (ms LeaderService) tryToLead(ctx context.Context, q dbx.QueriesX) bool {
+	// Only a machine the others can see is alive may lead
+	err := ms.alive(ctx, q)
+	if err != nil {
+		ms.logger.Debug("Not trying to lead", "error", err)
+		return false
+	}
+
+	leaderId := q.GetLeaderForType(ctx, ms.machineType)
+	switch leaderId {
+	case ms.machineId:
+		// Left over from before we lost leadership, it's still ours
+		return true
+	case misc.NilMachineId:
+	default:
+		machine, err := q.GetMachine(ctx, leaderId)
+		if err != nil {
+			ms.logger.Error("could not get the leader", "error", err)
+			return false
+		}
+		if time.Since(machine.LastUpdated) <= ms.liveness.MachineExpiry {
+			return false
+		}
+
+		ms.logger.Warn("Leader deadline exceeded, let's try to become the leader now")
+		lqc := leaderQueryContextImpl{
+			logger:      ms.logger,
+			machineId:   ms.machineId,
+			machineType: ms.machineType,
+			liveness:    ms.liveness,
+			database:    ms.database,
+			q:           q,
+			ctx:         ctx,
+		}
+		ms.onMachineOffline(lqc, machine.Uuid)
+		err = q.DeleteMachine(ctx, leaderId)
+		if err != nil {
+			ms.logger.Error("could not delete expired leader", "error", err)
+			return false
+		}
+	}
+
+	err = q.SetMachineAsLeader(ctx, ms.machineId)
+	if err != nil {
+		ms.logger.Error("could not become the leader", "error", err)
+		return false
+	}
+	return true
 }
@@ -0,0 +1,38 @@
+package leader
+
+import (
+	"time"
+
+	"github.com/hoyle1974/chorus/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	leading = promauto.With(metrics.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chorus_leader",
+		Help: "1 while this machine is the leader for its type",
+	}, []string{"machine_type"})
+	leaderTicks = promauto.With(metrics.Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name: "chorus_leader_tick_seconds",
+		Help: "How long each leader tick took, expiring machines included",
+	}, []string{"machine_type"})
+	leadershipLost = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chorus_leader_lost_total",
+		Help: "Times this machine stopped being the leader without stepping down",
+	}, []string{"machine_type"})
+)
+
+// tick is the leader's work for one tick
+func (ms LeaderService) tick(lqc leaderQueryContextImpl) {
+	start := time.Now()
+	ms.expireMachines(lqc)
+	ms.onLeaderTick(lqc)
+	leaderTicks.WithLabelValues(ms.machineType).Observe(time.Since(start).Seconds())
+}
+
+// lost tells onLeadershipLost we are no longer the leader
+func (ms LeaderService) lost(lqc leaderQueryContextImpl) {
+	leadershipLost.WithLabelValues(ms.machineType).Inc()
+	ms.onLeadershipLost(lqc)
+}
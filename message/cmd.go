@@ -51,3 +51,43 @@ func (m *ClientCmd) Topic() misc.TopicId {
 func (m *ClientCmd) Unmarshal(payload []byte) {
 	json.Unmarshal(payload, &m)
 }
+
+// RoomCmd is sent from one RoomServer to another about a room
+type RoomCmd struct {
+	MachineId misc.MachineId
+	SenderId  misc.MachineId
+	RoomId    misc.RoomId
+	Cmd       string
+	Data      map[string]interface{}
+}
+
+func NewRoomCmd(machineId misc.MachineId, senderId misc.MachineId, roomId misc.RoomId, cmd string, data map[string]interface{}) RoomCmd {
+	if machineId == "" {
+		panic("machineId must exist")
+	}
+	if cmd == "" {
+		panic("cmd must have a value")
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	return RoomCmd{
+		MachineId: machineId,
+		SenderId:  senderId,
+		RoomId:    roomId,
+		Cmd:       cmd,
+		Data:      data,
+	}
+}
+
+func (m *RoomCmd) String() string {
+	jsonData, _ := json.Marshal(m)
+	return string(jsonData)
+}
+func (m *RoomCmd) Topic() misc.TopicId {
+	return m.MachineId.RoomCmdTopic()
+}
+func (m *RoomCmd) Unmarshal(payload []byte) {
+	json.Unmarshal(payload, &m)
+}
@@ -12,10 +12,15 @@ type Message struct {
 	ReceiverId misc.ListenerId
 	Cmd        string
 	Data       map[string]interface{}
+	// Epoch is set on messages a room sends, it is the epoch of the
+	// machine that owned the room when it was sent
+	Epoch int64 `json:",omitempty"`
 }
 
-func Join(roomId misc.RoomId, connectionId misc.ConnectionId) Message {
-	return NewMessage(roomId, misc.ListenerId(connectionId), "", "Join", map[string]interface{}{})
+// Join tells a room a connection has joined, UserId in the data is the
+// authenticated user behind the connection
+func Join(roomId misc.RoomId, connectionId misc.ConnectionId, userId string) Message {
+	return NewMessage(roomId, misc.ListenerId(connectionId), "", "Join", map[string]interface{}{"UserId": userId})
 }
 func Leave(roomId misc.RoomId, connectionId misc.ConnectionId) Message {
 	return NewMessage(roomId, misc.ListenerId(connectionId), "", "Leave", map[string]interface{}{})
@@ -0,0 +1,42 @@
+// Package metrics is the Prometheus registry every chorus package records
+// into, and the HTTP endpoint that serves it.
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds chorus's metrics along with the Go runtime and process
+// ones.  Packages declare theirs with promauto.With(metrics.Registry).
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Serve exposes Registry at /metrics on addr in the background, an empty
+// addr turns it off
+func Serve(logger *slog.Logger, addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+
+	logger.Info("Metrics listening on " + addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logger.Error("Error serving metrics", "error", err)
+		}
+	}()
+}
@@ -42,9 +42,15 @@ type MachineId string
 func (id MachineId) MachineKey() string {
 	return string("machines/" + id)
 }
+func (id MachineId) ListenerId() ListenerId {
+	return ListenerId(id)
+}
 func (id MachineId) ClientCmdTopic() TopicId {
 	return TopicId("ClientCmd-" + id)
 }
+func (id MachineId) RoomCmdTopic() TopicId {
+	return TopicId("RoomCmd-" + id)
+}
 
 const globalLobbyId = RoomId("GlobalLobby")
 
@@ -21,3 +21,11 @@ func UUIDString() string {
 
 	return encodedString
 }
+
+// TokenString returns a random string long enough to be used as a secret
+func TokenString() string {
+	token := make([]byte, 24)
+	rand.Read(token)
+
+	return encode(token)
+}
@@ -0,0 +1,31 @@
+package pubsub
+
+import (
+	"fmt"
+
+	"github.com/hoyle1974/chorus/config"
+)
+
+// NewBus makes the Bus cfg.Backend names
+//
+//	kafka         - Kafka or Redpanda at cfg.Brokers
+//	nats          - NATS JetStream at cfg.NATSURL
+//	nats-embedded - start a NATS server in this process on cfg.NATSPort,
+//	                the rest of the cluster connects to it with nats
+func NewBus(cfg config.PubSub) (Bus, error) {
+	switch cfg.Backend {
+	case "kafka":
+		return NewKafkaBus(cfg.Brokers...), nil
+
+	case "nats":
+		return NewNATSBus(cfg.NATSURL)
+
+	case "nats-embedded":
+		ns, err := StartEmbeddedNATS(cfg.NATSPort, cfg.NATSStoreDir)
+		if err != nil {
+			return nil, err
+		}
+		return NewNATSBus(ns.ClientURL())
+	}
+	return nil, fmt.Errorf("unknown pubsub %q", cfg.Backend)
+}
@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaBus is a Bus on Kafka (or Redpanda), every topic has one partition
+type KafkaBus struct {
+	kafkaConn
+}
+
+func NewKafkaBus(brokers ...string) *KafkaBus {
+	return &KafkaBus{kafkaConn: kafkaConn{brokers: brokers}}
+}
+
+func (k *KafkaBus) SendMessage(msg Message) {
+	countSent(msg)
+	k.getConn().Produce(
+		context.Background(),
+		&kgo.Record{
+			Topic: string(msg.Topic()),
+			Value: []byte(msg.String()),
+		}, nil)
+}
+
+func (k *KafkaBus) TopicExists(topic misc.TopicId) bool {
+	ctx := context.Background()
+	client := k.newAdminConn()
+	defer client.Close()
+
+	topicsMetadata, err := client.ListTopics(ctx)
+	if err != nil {
+		panic(err)
+	}
+	for _, metadata := range topicsMetadata {
+		if metadata.Topic == string(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KafkaBus) CreateTopic(topic misc.TopicId) {
+	ctx := context.Background()
+	client := k.newAdminConn()
+	defer client.Close()
+
+	_, err := client.CreateTopic(ctx, 1, 1, nil, string(topic))
+	if err != nil {
+		fmt.Printf("Error trying to create: [%v]\n", topic)
+		panic(err)
+	}
+}
+
+func (k *KafkaBus) DeleteTopic(topic misc.TopicId) {
+	ctx := context.Background()
+	client := k.newAdminConn()
+	defer client.Close()
+
+	_, err := client.DeleteTopic(ctx, string(topic))
+	if err != nil {
+		panic(err)
+	}
+	forgetTopic(topic)
+}
+
+type kafkaConsumer struct {
+	log        *slog.Logger
+	topic      misc.TopicId
+	msgHandler TopicMessageHandler
+	pubsub     *kgo.Client
+	grouped    bool
+	ready      atomic.Bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closeOnce  sync.Once
+}
+
+func (k *KafkaBus) NewConsumer(log *slog.Logger, groupID string, topic misc.TopicId, msgHandler TopicMessageHandler) Consumer {
+	client, err := k.newConn(
+		kgo.ConsumerGroup(groupID),
+		kgo.ConsumeTopics(string(topic)),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
+		// Only commit what a handler has finished with
+		kgo.AutoCommitMarks(),
+	)
+	if err != nil {
+		log.Error("Error creating client", "error", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &kafkaConsumer{log: log, topic: topic, msgHandler: msgHandler, pubsub: client, grouped: true, ctx: ctx, cancel: cancel}
+
+	return consumer
+}
+
+func (k *KafkaBus) NewConsumerAt(log *slog.Logger, topic misc.TopicId, offset int64, msgHandler TopicMessageHandler) Consumer {
+	start := kgo.NewOffset().AtStart()
+	if offset >= 0 {
+		start = kgo.NewOffset().At(offset)
+	}
+	client, err := k.newConn(
+		kgo.ConsumeTopics(string(topic)),
+		kgo.ConsumeResetOffset(start),
+	)
+	if err != nil {
+		log.Error("Error creating client", "error", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &kafkaConsumer{log: log, topic: topic, msgHandler: msgHandler, pubsub: client, ctx: ctx, cancel: cancel}
+
+	return consumer
+}
+
+func (c *kafkaConsumer) AddTopic(topic misc.TopicId) {
+	c.pubsub.AddConsumeTopics(string(topic))
+}
+
+// RemoveTopic stops consuming a topic.  In a group this causes a rebalance,
+// which commits whatever has been handled so far.
+func (c *kafkaConsumer) RemoveTopic(topic misc.TopicId) {
+	c.pubsub.PurgeTopicsFromConsuming(string(topic))
+}
+
+func (c *kafkaConsumer) StartConsumer(v Message) {
+	if !c.ready.CompareAndSwap(false, true) {
+		// Already consuming
+		return
+	}
+	go c.processMessages(v)
+}
+
+// Close stops consuming, commits what has been handled and leaves the group
+func (c *kafkaConsumer) Close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+
+		if c.grouped {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
+			defer cancel()
+			err := c.pubsub.CommitMarkedOffsets(ctx)
+			if err != nil {
+				c.log.Warn("Could not commit offsets", "topic", c.topic, "error", err)
+			}
+		}
+		c.pubsub.Close()
+	})
+}
+
+func (c *kafkaConsumer) processMessages(v Message) {
+	// Listen for messages until we are closed
+	for c.ctx.Err() == nil {
+		fetches := c.pubsub.PollFetches(c.ctx)
+		if fetches.IsClientClosed() {
+			return
+		}
+		iter := fetches.RecordIter()
+		for !iter.Done() && c.ctx.Err() == nil {
+			record := iter.Next()
+			v.Unmarshal([]byte(record.Value))
+			handleMessage(c.msgHandler, v, record.Offset)
+			if c.grouped {
+				c.pubsub.MarkCommitRecords(record)
+			}
+		}
+	}
+}
@@ -7,39 +7,42 @@ import (
 	"github.com/twmb/franz-go/pkg/kgo"
 )
 
-var conn atomic.Pointer[kgo.Client]
-var brokers = []string{"localhost:19092"}
+type kafkaConn struct {
+	brokers []string
+	conn    atomic.Pointer[kgo.Client]
+}
 
-func newConn() (*kgo.Client, error) {
+func (k *kafkaConn) newConn(opts ...kgo.Opt) (*kgo.Client, error) {
 	client, err := kgo.NewClient(
-		kgo.SeedBrokers(brokers...),
+		append([]kgo.Opt{kgo.SeedBrokers(k.brokers...)}, opts...)...,
 	)
 
 	return client, err
 }
 
-func getConn() *kgo.Client {
-	if conn.Load() != nil {
-		return conn.Load()
+func (k *kafkaConn) getConn() *kgo.Client {
+	if k.conn.Load() != nil {
+		return k.conn.Load()
 	}
 
-	db, err := newConn()
+	db, err := k.newConn()
 	if err != nil {
 		panic(err)
 	}
 
-	old := conn.Swap(db)
-	if old != nil {
-		old.Close()
+	if !k.conn.CompareAndSwap(nil, db) {
+		// Someone beat us to it
+		db.Close()
 	}
-	return db
+	return k.conn.Load()
 }
 
-func newAdminConn() *kadm.Client {
-	conn, _ := newConn()
+// newAdminConn has its own client as closing a kadm.Client closes the
+// client underneath it
+func (k *kafkaConn) newAdminConn() *kadm.Client {
+	conn, err := k.newConn()
+	if err != nil {
+		panic(err)
+	}
 	return kadm.NewClient(conn)
 }
-
-func getAdminConn() *kadm.Client {
-	return kadm.NewClient(getConn())
-}
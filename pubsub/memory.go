@@ -0,0 +1,196 @@
+package pubsub
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hoyle1974/chorus/misc"
+)
+
+// MemoryBus is a Bus that lives inside one process, so servers can be run
+// and tested without a broker.  It keeps the same semantics as a single
+// partition Kafka topic: each topic is an ordered log, each group sees every
+// message once and in order, and a new group starts at the end.  Topics are
+// created the first time they are used.
+type MemoryBus struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	topics  map[misc.TopicId][][]byte
+	offsets map[memoryGroupTopic]int
+}
+
+type memoryGroupTopic struct {
+	group string
+	topic misc.TopicId
+}
+
+func NewMemoryBus() *MemoryBus {
+	b := &MemoryBus{
+		topics:  map[misc.TopicId][][]byte{},
+		offsets: map[memoryGroupTopic]int{},
+	}
+	b.changed = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *MemoryBus) SendMessage(msg Message) {
+	countSent(msg)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.topics[msg.Topic()] = append(b.topics[msg.Topic()], []byte(msg.String()))
+	b.changed.Broadcast()
+}
+
+func (b *MemoryBus) CreateTopic(topic misc.TopicId) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = [][]byte{}
+	}
+}
+
+func (b *MemoryBus) DeleteTopic(topic misc.TopicId) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.topics, topic)
+	for key := range b.offsets {
+		if key.topic == topic {
+			delete(b.offsets, key)
+		}
+	}
+	forgetTopic(topic)
+}
+
+func (b *MemoryBus) TopicExists(topic misc.TopicId) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, ok := b.topics[topic]
+	return ok
+}
+
+func (b *MemoryBus) NewConsumer(log *slog.Logger, groupID string, topic misc.TopicId, msgHandler TopicMessageHandler) Consumer {
+	c := &memoryConsumer{
+		bus:        b,
+		log:        log,
+		group:      groupID,
+		msgHandler: msgHandler,
+		topics:     map[misc.TopicId]bool{},
+	}
+	c.AddTopic(topic)
+	return c
+}
+
+func (b *MemoryBus) NewConsumerAt(log *slog.Logger, topic misc.TopicId, offset int64, msgHandler TopicMessageHandler) Consumer {
+	c := &memoryConsumer{
+		bus:        b,
+		log:        log,
+		group:      "at-" + misc.UUIDString(), // a group of its own
+		msgHandler: msgHandler,
+		topics:     map[misc.TopicId]bool{},
+	}
+
+	b.lock.Lock()
+	if offset < 0 {
+		offset = 0
+	}
+	b.offsets[memoryGroupTopic{group: c.group, topic: topic}] = int(offset)
+	b.lock.Unlock()
+
+	c.AddTopic(topic)
+	return c
+}
+
+type memoryConsumer struct {
+	bus        *MemoryBus
+	log        *slog.Logger
+	group      string
+	msgHandler TopicMessageHandler
+	ready      atomic.Bool
+
+	// guarded by bus.lock
+	topics map[misc.TopicId]bool
+	closed bool
+}
+
+func (c *memoryConsumer) AddTopic(topic misc.TopicId) {
+	c.bus.lock.Lock()
+	defer c.bus.lock.Unlock()
+
+	c.topics[topic] = true
+	key := memoryGroupTopic{group: c.group, topic: topic}
+	if _, ok := c.bus.offsets[key]; !ok {
+		// A new group starts at the end
+		c.bus.offsets[key] = len(c.bus.topics[topic])
+	}
+	c.bus.changed.Broadcast()
+}
+
+func (c *memoryConsumer) RemoveTopic(topic misc.TopicId) {
+	c.bus.lock.Lock()
+	defer c.bus.lock.Unlock()
+
+	delete(c.topics, topic)
+}
+
+func (c *memoryConsumer) StartConsumer(v Message) {
+	if !c.ready.CompareAndSwap(false, true) {
+		// Already consuming
+		return
+	}
+	go c.processMessages(v)
+}
+
+func (c *memoryConsumer) Close() {
+	c.bus.lock.Lock()
+	defer c.bus.lock.Unlock()
+
+	c.closed = true
+	c.bus.changed.Broadcast()
+}
+
+// next claims the next message for our group on any of our topics, the
+// caller holds bus.lock
+func (c *memoryConsumer) next() ([]byte, int, bool) {
+	for topic := range c.topics {
+		key := memoryGroupTopic{group: c.group, topic: topic}
+		records := c.bus.topics[topic]
+		offset, ok := c.bus.offsets[key]
+		if !ok {
+			offset = len(records)
+		}
+		if offset < len(records) {
+			c.bus.offsets[key] = offset + 1
+			return records[offset], offset, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (c *memoryConsumer) processMessages(v Message) {
+	for {
+		c.bus.lock.Lock()
+		var record []byte
+		var offset int
+		ok := false
+		for !c.closed {
+			record, offset, ok = c.next()
+			if ok {
+				break
+			}
+			c.bus.changed.Wait()
+		}
+		c.bus.lock.Unlock()
+		if !ok {
+			return
+		}
+
+		v.Unmarshal(record)
+		handleMessage(c.msgHandler, v, int64(offset))
+	}
+}
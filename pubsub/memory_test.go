@@ -0,0 +1,302 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/chorus/metrics"
+	"github.com/hoyle1974/chorus/misc"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testMessage is a numbered message on a topic
+type testMessage struct {
+	To misc.TopicId
+	N  int
+}
+
+func (m *testMessage) String() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+func (m *testMessage) Topic() misc.TopicId { return m.To }
+func (m *testMessage) Unmarshal(b []byte)  { json.Unmarshal(b, m) }
+
+// collector is a handler that remembers what it was given
+type collector struct {
+	lock    sync.Mutex
+	got     []string
+	offsets []int64
+}
+
+func (c *collector) OnMessageFromTopicAt(msg Message, offset int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m := msg.(*testMessage)
+	c.got = append(c.got, string(m.To)+":"+strconv.Itoa(m.N))
+	c.offsets = append(c.offsets, offset)
+}
+
+func (c *collector) OnMessageFromTopic(msg Message) {}
+
+// wait gives consumers time to catch up and returns what c was given
+func (c *collector) wait(t *testing.T, want int) []string {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.lock.Lock()
+		got := slices.Clone(c.got)
+		c.lock.Unlock()
+		if len(got) >= want || time.Now().After(deadline) {
+			// Anything past want would show up by now too
+			time.Sleep(10 * time.Millisecond)
+			c.lock.Lock()
+			got = slices.Clone(c.got)
+			c.lock.Unlock()
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func send(bus Bus, topic misc.TopicId, from int, to int) {
+	for n := from; n < to; n++ {
+		bus.SendMessage(&testMessage{To: topic, N: n})
+	}
+}
+
+func numbered(topic misc.TopicId, from int, to int) []string {
+	ret := []string{}
+	for n := from; n < to; n++ {
+		ret = append(ret, string(topic)+":"+strconv.Itoa(n))
+	}
+	return ret
+}
+
+func TestMemoryBusOrder(t *testing.T) {
+	bus := NewMemoryBus()
+	c := &collector{}
+	consumer := bus.NewConsumer(testLogger, "group", "T", c)
+	consumer.StartConsumer(&testMessage{})
+	defer consumer.Close()
+
+	send(bus, "T", 0, 100)
+
+	got := c.wait(t, 100)
+	if !slices.Equal(got, numbered("T", 0, 100)) {
+		t.Errorf("got %v", got)
+	}
+	for i, offset := range c.offsets {
+		if offset != int64(i) {
+			t.Fatalf("offsets = %v, want 0 to 99", c.offsets)
+		}
+	}
+}
+
+func TestMemoryBusGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, bus *MemoryBus)
+	}{
+		{
+			name: "a new group starts at the end",
+			run: func(t *testing.T, bus *MemoryBus) {
+				send(bus, "T", 0, 3)
+				c := &collector{}
+				consumer := bus.NewConsumer(testLogger, "late", "T", c)
+				consumer.StartConsumer(&testMessage{})
+				defer consumer.Close()
+				send(bus, "T", 3, 5)
+
+				if got := c.wait(t, 2); !slices.Equal(got, numbered("T", 3, 5)) {
+					t.Errorf("got %v", got)
+				}
+			},
+		},
+		{
+			name: "every group sees every message",
+			run: func(t *testing.T, bus *MemoryBus) {
+				a, b := &collector{}, &collector{}
+				ca := bus.NewConsumer(testLogger, "a", "T", a)
+				cb := bus.NewConsumer(testLogger, "b", "T", b)
+				ca.StartConsumer(&testMessage{})
+				cb.StartConsumer(&testMessage{})
+				defer ca.Close()
+				defer cb.Close()
+				send(bus, "T", 0, 10)
+
+				if got := a.wait(t, 10); !slices.Equal(got, numbered("T", 0, 10)) {
+					t.Errorf("group a got %v", got)
+				}
+				if got := b.wait(t, 10); !slices.Equal(got, numbered("T", 0, 10)) {
+					t.Errorf("group b got %v", got)
+				}
+			},
+		},
+		{
+			name: "a group shares its messages out once",
+			run: func(t *testing.T, bus *MemoryBus) {
+				// Both hand what they get to one collector
+				c := &collector{}
+				ca := bus.NewConsumer(testLogger, "g", "T", c)
+				cb := bus.NewConsumer(testLogger, "g", "T", c)
+				ca.StartConsumer(&testMessage{})
+				cb.StartConsumer(&testMessage{})
+				defer ca.Close()
+				defer cb.Close()
+				send(bus, "T", 0, 50)
+
+				got := c.wait(t, 50)
+				slices.SortFunc(got, func(x, y string) int {
+					nx, _ := strconv.Atoi(x[2:])
+					ny, _ := strconv.Atoi(y[2:])
+					return nx - ny
+				})
+				if !slices.Equal(got, numbered("T", 0, 50)) {
+					t.Errorf("got %v", got)
+				}
+			},
+		},
+		{
+			name: "a group picks up where it left off",
+			run: func(t *testing.T, bus *MemoryBus) {
+				first := &collector{}
+				consumer := bus.NewConsumer(testLogger, "g", "T", first)
+				consumer.StartConsumer(&testMessage{})
+				send(bus, "T", 0, 3)
+				first.wait(t, 3)
+				consumer.Close()
+
+				send(bus, "T", 3, 6)
+				second := &collector{}
+				consumer = bus.NewConsumer(testLogger, "g", "T", second)
+				consumer.StartConsumer(&testMessage{})
+				defer consumer.Close()
+
+				if got := second.wait(t, 3); !slices.Equal(got, numbered("T", 3, 6)) {
+					t.Errorf("got %v", got)
+				}
+			},
+		},
+		{
+			name: "NewConsumerAt reads from an offset outside any group",
+			run: func(t *testing.T, bus *MemoryBus) {
+				send(bus, "T", 0, 5)
+				c := &collector{}
+				consumer := bus.NewConsumerAt(testLogger, "T", 2, c)
+				consumer.StartConsumer(&testMessage{})
+				defer consumer.Close()
+
+				if got := c.wait(t, 3); !slices.Equal(got, numbered("T", 2, 5)) {
+					t.Errorf("got %v", got)
+				}
+				if !slices.Equal(c.offsets, []int64{2, 3, 4}) {
+					t.Errorf("offsets = %v", c.offsets)
+				}
+			},
+		},
+		{
+			name: "topics are kept apart and in order",
+			run: func(t *testing.T, bus *MemoryBus) {
+				c := &collector{}
+				consumer := bus.NewConsumer(testLogger, "g", "A", c)
+				consumer.AddTopic("B")
+				consumer.StartConsumer(&testMessage{})
+				defer consumer.Close()
+				send(bus, "A", 0, 5)
+				send(bus, "B", 0, 5)
+
+				got := c.wait(t, 10)
+				var a, b []string
+				for _, m := range got {
+					if m[0] == 'A' {
+						a = append(a, m)
+					} else {
+						b = append(b, m)
+					}
+				}
+				if !slices.Equal(a, numbered("A", 0, 5)) || !slices.Equal(b, numbered("B", 0, 5)) {
+					t.Errorf("got %v", got)
+				}
+			},
+		},
+		{
+			name: "a deleted topic starts again empty",
+			run: func(t *testing.T, bus *MemoryBus) {
+				send(bus, "T", 0, 3)
+				bus.DeleteTopic("T")
+				if bus.TopicExists("T") {
+					t.Fatal("T still exists")
+				}
+				c := &collector{}
+				consumer := bus.NewConsumerAt(testLogger, "T", -1, c)
+				consumer.StartConsumer(&testMessage{})
+				defer consumer.Close()
+				send(bus, "T", 3, 4)
+
+				if got := c.wait(t, 1); !slices.Equal(got, numbered("T", 3, 4)) {
+					t.Errorf("got %v", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, NewMemoryBus())
+		})
+	}
+}
+
+// roomCount is the value of the named counter for a room, false if it has
+// no series
+func roomCount(t *testing.T, name string, room string) (float64, bool) {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "room" && label.GetValue() == room {
+					return m.GetCounter().GetValue(), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestDeleteTopicForgetsRoomMetrics(t *testing.T) {
+	bus := NewMemoryBus()
+	c := &collector{}
+	consumer := bus.NewConsumer(testLogger, "g", "R-metrics", c)
+	consumer.StartConsumer(&testMessage{})
+	defer consumer.Close()
+	send(bus, "R-metrics", 0, 2)
+	c.wait(t, 2)
+
+	for _, name := range []string{"chorus_pubsub_messages_sent_total", "chorus_pubsub_messages_received_total"} {
+		if got, _ := roomCount(t, name, "R-metrics"); got != 2 {
+			t.Errorf("%s = %v, want 2", name, got)
+		}
+	}
+
+	bus.DeleteTopic("R-metrics")
+	for _, name := range []string{"chorus_pubsub_messages_sent_total", "chorus_pubsub_messages_received_total"} {
+		if _, ok := roomCount(t, name, "R-metrics"); ok {
+			t.Errorf("%s still has the room's series", name)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"strings"
+
+	"github.com/hoyle1974/chorus/metrics"
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Messages are counted by the kind of topic they were on, and by room for
+// room topics.  A room's series go when its topic is deleted so they don't
+// pile up as rooms come and go.
+var (
+	messagesSent = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chorus_pubsub_messages_sent_total",
+		Help: "Messages sent, by kind of topic (room, ClientCmd or RoomCmd) and room",
+	}, []string{"topic_kind", "room"})
+	messagesReceived = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chorus_pubsub_messages_received_total",
+		Help: "Messages handed to a consumer's handler, by kind of topic (room, ClientCmd or RoomCmd) and room",
+	}, []string{"topic_kind", "room"})
+)
+
+func countSent(msg Message) {
+	messagesSent.WithLabelValues(topicLabels(msg.Topic())...).Inc()
+}
+
+func countReceived(msg Message) {
+	messagesReceived.WithLabelValues(topicLabels(msg.Topic())...).Inc()
+}
+
+// topicLabels are the topic_kind and room labels for topic, room is empty
+// for a machine's topics
+func topicLabels(topic misc.TopicId) []string {
+	kind := topicKind(topic)
+	if kind != "room" {
+		return []string{kind, ""}
+	}
+	return []string{kind, string(topic)}
+}
+
+// forgetTopic drops the series of a deleted room topic
+func forgetTopic(topic misc.TopicId) {
+	if topicKind(topic) != "room" {
+		return
+	}
+	room := prometheus.Labels{"topic_kind": "room", "room": string(topic)}
+	messagesSent.DeletePartialMatch(room)
+	messagesReceived.DeletePartialMatch(room)
+}
+
+// topicKind is ClientCmd or RoomCmd for a machine's topics, see misc.MachineId,
+// and room for everything else
+func topicKind(topic misc.TopicId) string {
+	for _, kind := range []string{"ClientCmd", "RoomCmd"} {
+		if strings.HasPrefix(string(topic), kind+"-") {
+			return kind
+		}
+	}
+	return "room"
+}
@@ -0,0 +1,322 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoyle1974/chorus/misc"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSBus is a Bus on NATS JetStream.  Each topic is a stream holding the
+// single subject chorus.<topic>, so GlobalLobby is chorus.GlobalLobby and a
+// machine's ClientCmd topic is chorus.ClientCmd-Machine_EUS_xxxx.  Each
+// consumer group is a durable consumer on the topic's stream.
+type NATSBus struct {
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+const (
+	// Durable consumers nobody has used for this long are cleaned up by the server
+	natsInactiveThreshold = time.Duration(1) * time.Hour
+	// A message handed to a consumer that went away is redelivered after this
+	natsAckWait = time.Duration(10) * time.Second
+	// Pull requests are kept short and small so a closed consumer strands as
+	// few messages as possible
+	natsPullExpiry      = jetstream.PullExpiry(time.Second)
+	natsPullMaxMessages = jetstream.PullMaxMessages(16)
+)
+
+func NewNATSBus(url string) (*NATSBus, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats at %s: %w", url, err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("jetstream: %w", err)
+	}
+	return &NATSBus{nc: nc, js: js}, nil
+}
+
+// StartEmbeddedNATS runs a NATS server with JetStream inside this process.
+// Other processes reach it at the returned server's ClientURL().
+func StartEmbeddedNATS(port int, storeDir string) (*server.Server, error) {
+	ns, err := server.NewServer(&server.Options{
+		Port:      port,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoSigs:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(time.Duration(10) * time.Second) {
+		ns.Shutdown()
+		return nil, errors.New("embedded nats server did not start")
+	}
+	return ns, nil
+}
+
+// Stream and durable names can't have dots in them
+func natsName(s string) string {
+	return strings.ReplaceAll(s, ".", "_")
+}
+
+func natsSubject(topic misc.TopicId) string {
+	return "chorus." + natsName(string(topic))
+}
+
+func natsTimeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
+}
+
+func (b *NATSBus) SendMessage(msg Message) {
+	countSent(msg)
+
+	ctx, cancel := natsTimeout()
+	defer cancel()
+
+	_, err := b.js.Publish(ctx, natsSubject(msg.Topic()), []byte(msg.String()))
+	if errors.Is(err, jetstream.ErrNoStreamResponse) {
+		// Like Kafka, topics come into being when they are used
+		b.CreateTopic(msg.Topic())
+		_, err = b.js.Publish(ctx, natsSubject(msg.Topic()), []byte(msg.String()))
+	}
+	if err != nil {
+		slog.Error("Could not publish message", "topic", msg.Topic(), "error", err)
+	}
+}
+
+func (b *NATSBus) TopicExists(topic misc.TopicId) bool {
+	ctx, cancel := natsTimeout()
+	defer cancel()
+
+	_, err := b.js.Stream(ctx, natsName(string(topic)))
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (b *NATSBus) CreateTopic(topic misc.TopicId) {
+	ctx, cancel := natsTimeout()
+	defer cancel()
+
+	_, err := b.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     natsName(string(topic)),
+		Subjects: []string{natsSubject(topic)},
+	})
+	if err != nil {
+		fmt.Printf("Error trying to create: [%v]\n", topic)
+		panic(err)
+	}
+}
+
+func (b *NATSBus) DeleteTopic(topic misc.TopicId) {
+	ctx, cancel := natsTimeout()
+	defer cancel()
+
+	err := b.js.DeleteStream(ctx, natsName(string(topic)))
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+		panic(err)
+	}
+	forgetTopic(topic)
+}
+
+type natsConsumer struct {
+	bus        *NATSBus
+	log        *slog.Logger
+	group      string // empty for an ordered consumer from NewConsumerAt
+	startSeq   uint64
+	msgHandler TopicMessageHandler
+	ready      atomic.Bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closeOnce  sync.Once
+	msgs       chan jetstream.Msg
+
+	lock  sync.Mutex
+	iters map[misc.TopicId]jetstream.MessagesContext
+}
+
+func (b *NATSBus) NewConsumer(log *slog.Logger, groupID string, topic misc.TopicId, msgHandler TopicMessageHandler) Consumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &natsConsumer{
+		bus:        b,
+		log:        log,
+		group:      groupID,
+		msgHandler: msgHandler,
+		ctx:        ctx,
+		cancel:     cancel,
+		msgs:       make(chan jetstream.Msg),
+		iters:      map[misc.TopicId]jetstream.MessagesContext{},
+	}
+	c.AddTopic(topic)
+	return c
+}
+
+// NewConsumerAt uses an ordered consumer, offsets are stream sequence numbers
+func (b *NATSBus) NewConsumerAt(log *slog.Logger, topic misc.TopicId, offset int64, msgHandler TopicMessageHandler) Consumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &natsConsumer{
+		bus:        b,
+		log:        log,
+		msgHandler: msgHandler,
+		ctx:        ctx,
+		cancel:     cancel,
+		msgs:       make(chan jetstream.Msg),
+		iters:      map[misc.TopicId]jetstream.MessagesContext{},
+	}
+	if offset > 0 {
+		c.startSeq = uint64(offset)
+	}
+	c.AddTopic(topic)
+	return c
+}
+
+func (c *natsConsumer) newJSConsumer(ctx context.Context, topic misc.TopicId) (jetstream.Consumer, error) {
+	if c.group == "" {
+		config := jetstream.OrderedConsumerConfig{DeliverPolicy: jetstream.DeliverAllPolicy}
+		if c.startSeq > 0 {
+			config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+			config.OptStartSeq = c.startSeq
+		}
+		return c.bus.js.OrderedConsumer(ctx, natsName(string(topic)), config)
+	}
+	return c.bus.js.CreateOrUpdateConsumer(ctx, natsName(string(topic)), jetstream.ConsumerConfig{
+		Durable:           natsName(c.group),
+		DeliverPolicy:     jetstream.DeliverNewPolicy,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		AckWait:           natsAckWait,
+		InactiveThreshold: natsInactiveThreshold,
+	})
+}
+
+func (c *natsConsumer) AddTopic(topic misc.TopicId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.iters[topic]; ok {
+		return
+	}
+
+	ctx, cancel := natsTimeout()
+	defer cancel()
+
+	// The stream has to exist before we can have a durable on it
+	_, err := c.bus.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     natsName(string(topic)),
+		Subjects: []string{natsSubject(topic)},
+	})
+	if err != nil {
+		c.log.Error("Could not create stream", "topic", topic, "error", err)
+		return
+	}
+	cons, err := c.newJSConsumer(ctx, topic)
+	if err != nil {
+		c.log.Error("Could not create consumer", "topic", topic, "error", err)
+		return
+	}
+	iter, err := cons.Messages(natsPullExpiry, natsPullMaxMessages)
+	if err != nil {
+		c.log.Error("Could not consume", "topic", topic, "error", err)
+		return
+	}
+	c.iters[topic] = iter
+
+	go c.pump(iter)
+}
+
+// pump feeds a topic's messages into the one channel so the handler sees a
+// message at a time.  Once the iterator is drained, whatever was buffered is
+// handed back to the group straight away.
+func (c *natsConsumer) pump(iter jetstream.MessagesContext) {
+	for {
+		msg, err := iter.Next()
+		if err != nil {
+			return
+		}
+		select {
+		case c.msgs <- msg:
+		case <-c.ctx.Done():
+			if c.group != "" {
+				msg.Nak()
+			}
+		}
+	}
+}
+
+// RemoveTopic stops consuming a topic, anything not yet handled goes back to
+// the group
+func (c *natsConsumer) RemoveTopic(topic misc.TopicId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	iter, ok := c.iters[topic]
+	if ok {
+		iter.Drain()
+		delete(c.iters, topic)
+	}
+}
+
+func (c *natsConsumer) StartConsumer(v Message) {
+	if !c.ready.CompareAndSwap(false, true) {
+		// Already consuming
+		return
+	}
+	go c.processMessages(v)
+}
+
+// Close stops consuming, handled messages have already been acked so the
+// durable consumer remembers where we got to
+func (c *natsConsumer) Close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for topic, iter := range c.iters {
+			iter.Drain()
+			delete(c.iters, topic)
+		}
+	})
+}
+
+func (c *natsConsumer) processMessages(v Message) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case msg := <-c.msgs:
+			offset := int64(-1)
+			meta, err := msg.Metadata()
+			if err == nil {
+				offset = int64(meta.Sequence.Stream)
+			}
+
+			v.Unmarshal(msg.Data())
+			handleMessage(c.msgHandler, v, offset)
+			if c.group == "" {
+				continue
+			}
+			err = msg.Ack()
+			if err != nil {
+				c.log.Warn("Could not ack message", "subject", msg.Subject(), "error", err)
+			}
+		}
+	}
+}
@@ -1,122 +1,64 @@
 package pubsub
 
 import (
-	"context"
-	"fmt"
 	"log/slog"
-	"sync/atomic"
 
 	"github.com/hoyle1974/chorus/misc"
-	"github.com/twmb/franz-go/pkg/kgo"
 )
 
 type TopicMessageHandler interface {
 	OnMessageFromTopic(msg Message)
 }
 
-type Message interface {
-	String() string
-	Topic() misc.TopicId
-	Unmarshal([]byte)
-}
-
-func SendMessage(msg Message) {
-	getConn().Produce(
-		context.Background(),
-		&kgo.Record{
-			Topic: string(msg.Topic()),
-			Value: []byte(msg.String()),
-		}, nil)
-}
-
-type Consumer struct {
-	log        *slog.Logger
-	topic      misc.TopicId
-	msgHandler TopicMessageHandler
-	pubsub     *kgo.Client
-	ready      atomic.Bool
-}
-
-func TopicExists(topic misc.TopicId) bool {
-	ctx := context.Background()
-	client := getAdminConn()
-	defer client.Close()
-
-	topicsMetadata, err := client.ListTopics(ctx)
-	if err != nil {
-		panic(err)
-	}
-	for _, metadata := range topicsMetadata {
-		if metadata.Topic == string(topic) {
-			return true
-		}
-	}
-	return false
-}
-
-func CreateTopic(topic misc.TopicId) {
-	ctx := context.Background()
-	client := newAdminConn()
-	defer client.Close()
-
-	_, err := client.CreateTopic(ctx, 1, 1, nil, string(topic))
-	if err != nil {
-		fmt.Printf("Error trying to create: [%v]\n", topic)
-		panic(err)
-	}
-}
-
-func DeleteTopic(topic misc.TopicId) {
-	ctx := context.Background()
-	client := getAdminConn()
-	defer client.Close()
-
-	_, err := client.DeleteTopic(ctx, string(topic))
-	if err != nil {
-		panic(err)
-	}
+// A TopicOffsetHandler is a TopicMessageHandler that also wants to know where
+// each message sits in its topic.  Consumers call OnMessageFromTopicAt
+// instead of OnMessageFromTopic when the handler has it, and handing
+// offset+1 to Bus.NewConsumerAt picks up right after that message.
+type TopicOffsetHandler interface {
+	OnMessageFromTopicAt(msg Message, offset int64)
 }
 
-func NewConsumer(log *slog.Logger, groupID string, topic misc.TopicId, msgHandler TopicMessageHandler) *Consumer {
-	client, err := kgo.NewClient(
-		kgo.SeedBrokers(brokers...),
-		kgo.ConsumerGroup(groupID),
-		kgo.ConsumeTopics(string(topic)),
-		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
-	)
-	if err != nil {
-		log.Error("Error creating client", "error", err)
-		return nil
+func handleMessage(h TopicMessageHandler, msg Message, offset int64) {
+	countReceived(msg)
+	if oh, ok := h.(TopicOffsetHandler); ok {
+		oh.OnMessageFromTopicAt(msg, offset)
+		return
 	}
-
-	consumer := &Consumer{log: log, topic: topic, msgHandler: msgHandler, pubsub: client}
-
-	return consumer
+	h.OnMessageFromTopic(msg)
 }
 
-func (c *Consumer) AddTopic(topic misc.TopicId) {
-	c.pubsub.AddConsumeTopics(string(topic))
-}
-
-func (c *Consumer) RemoveTopic(topic misc.TopicId) {
-	c.log.Warn("RemoveTopic - not implemented")
+type Message interface {
+	String() string
+	Topic() misc.TopicId
+	Unmarshal([]byte)
 }
 
-func (c *Consumer) StartConsumer(v Message) {
-	c.ready.Store(true)
-	go c.processMessages(v)
+// A Bus moves messages between machines.  Each topic is an ordered log,
+// every consumer group sees each message on a topic once and in order, and
+// a new group starts at the end of the topic.
+type Bus interface {
+	SendMessage(msg Message)
+	CreateTopic(topic misc.TopicId)
+	DeleteTopic(topic misc.TopicId)
+	TopicExists(topic misc.TopicId) bool
+	NewConsumer(log *slog.Logger, groupID string, topic misc.TopicId, msgHandler TopicMessageHandler) Consumer
+	// NewConsumerAt reads one topic starting at offset, outside of any group
+	// so nothing is remembered when it closes.  A negative offset starts at
+	// the beginning of the topic.
+	NewConsumerAt(log *slog.Logger, topic misc.TopicId, offset int64, msgHandler TopicMessageHandler) Consumer
 }
 
-func (c *Consumer) processMessages(v Message) {
-	// Listen for messages
-	ctx := context.Background()
-	for {
-		fetches := c.pubsub.PollFetches(ctx)
-		iter := fetches.RecordIter()
-		for !iter.Done() {
-			record := iter.Next()
-			v.Unmarshal([]byte(record.Value))
-			c.msgHandler.OnMessageFromTopic(v)
-		}
-	}
+// A Consumer feeds the messages on its topics to a TopicMessageHandler, one
+// at a time, on its own goroutine
+type Consumer interface {
+	AddTopic(topic misc.TopicId)
+	// RemoveTopic stops consuming a topic
+	RemoveTopic(topic misc.TopicId)
+	// StartConsumer starts handing messages to the handler, each one is
+	// unmarshalled into v first
+	StartConsumer(v Message)
+	// Close stops consuming and remembers how far the group got, so a later
+	// consumer in the same group carries on from here.  It is safe to call
+	// from inside a message handler.
+	Close()
 }
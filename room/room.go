@@ -16,10 +16,13 @@ import (
 
 // -------------- OLD functions
 
+// Bus carries messages for the old room code
+var Bus pubsub.Bus
+
 func GetGlobalLobby(logger *slog.Logger) misc.RoomId {
 	lobby, err := NewRoomWithId(logger, misc.GetGlobalLobbyId(), "Default Lobby", "matchmaker.js")
 	if err != nil {
-		logger.Error("Error creating default lobby", err)
+		logger.Error("Error creating default lobby", "err", err)
 		return ""
 	}
 	return lobby.RoomId
@@ -40,7 +43,7 @@ type Room struct {
 	ctx        *v8go.Context
 	style      lipgloss.Style
 	listeners  map[misc.ListenerId]RoomListener
-	consumer   *pubsub.Consumer
+	consumer   pubsub.Consumer
 }
 
 func (r *Room) HasListener(listenerId misc.ListenerId) bool {
@@ -171,7 +174,7 @@ func createScriptEnvironmentForRoom(room *Room, adminScriptFilename string) (*v8
 		objTemplate := room.JSTemplate(isolate)
 		obj, err := objTemplate.NewInstance(room.ctx)
 		if err != nil {
-			room.logger.Error(room.style.Render(fmt.Sprintf("js objTemplate NewInstance: %w", err)))
+			room.logger.Error(room.style.Render("js objTemplate NewInstance"), "err", err)
 			return nil
 		}
 		return obj.Value
@@ -234,7 +237,7 @@ func NewRoomWithId(baseLogger *slog.Logger, roomId misc.RoomId, name string, adm
 	// } else {
 	// 	room.logger.Info("Topic already exists")
 	// }
-	//room.consumer = pubsub.NewConsumer(room.RoomId.Topic(), room)
+	//room.consumer = Bus.NewConsumer(room.RoomId.Topic(), room)
 
 	roomLock.Lock()
 	defer roomLock.Unlock()
@@ -277,7 +280,7 @@ func (r *Room) callJSOnMessage(msg message.Message) error {
 }
 
 func (r *Room) sendMsg(msg message.Message) {
-	pubsub.SendMessage(&msg)
+	Bus.SendMessage(&msg)
 	/*
 		if msg.ReceiverId != "" {
 			l := r.listeners[msg.ReceiverId]
@@ -371,7 +374,7 @@ func (r *Room) send(msg message.Message) error {
 }
 
 var consumersLock = sync.Mutex{}
-var consumers = map[string]*pubsub.Consumer{}
+var consumers = map[string]pubsub.Consumer{}
 var roomsByListener = map[misc.ListenerId][]misc.RoomId{}
 
 func Join(roomId misc.RoomId, listenerId misc.ListenerId, handler pubsub.TopicMessageHandler) {
@@ -380,7 +383,7 @@ func Join(roomId misc.RoomId, listenerId misc.ListenerId, handler pubsub.TopicMe
 
 	consumerId := string(roomId + ":" + misc.RoomId(listenerId))
 	consumersLock.Lock()
-	consumer := pubsub.NewConsumer(nil, string(listenerId), roomId.Topic(), handler)
+	consumer := Bus.NewConsumer(nil, string(listenerId), roomId.Topic(), handler)
 	consumers[consumerId] = consumer
 	list, ok := roomsByListener[listenerId]
 	if !ok {
@@ -436,5 +439,5 @@ func RemoveAllRooms() {
 }
 
 func Send(msg message.Message) {
-	pubsub.SendMessage(&msg)
+	Bus.SendMessage(&msg)
 }
@@ -5,20 +5,29 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/hoyle1974/chorus/config"
 	"github.com/redis/go-redis/v9"
 )
 
 var conn atomic.Pointer[redis.Client]
 
+var redisConfig = config.Default().Redis
+
+// Configure sets the Redis server to use, call it before anything else in
+// store
+func Configure(cfg config.Redis) {
+	redisConfig = cfg
+}
+
 func getConn() *redis.Client {
 	if conn.Load() != nil {
 		return conn.Load()
 	}
 
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:     redisConfig.Addr,
+		Password: redisConfig.Password,
+		DB:       redisConfig.DB,
 	})
 
 	old := conn.Swap(rdb)